@@ -0,0 +1,511 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// arithOps are the operators of arithmetic expressions, longest first
+// so that the tokenizer can match greedily
+var arithOps = []string{
+	"<<=", ">>=", "**",
+	"++", "--", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+=", "-=", "*=", "/=", "%=", "&=", "^=", "|=",
+	"+", "-", "*", "/", "%", "<", ">", "&", "|", "^", "!", "~",
+	"?", ":", "=", ",", "(", ")",
+}
+
+// arithLevels are the binary operators from the loosest to the tightest
+// binding precedence level. All of them are left associative.
+var arithLevels = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", ">", "<=", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// maxArithDepth limits how deeply variables holding expressions are
+// evaluated, so that x=x does not recurse forever
+const maxArithDepth = 64
+
+// arith evaluates an integer arithmetic expression. It evaluates while
+// parsing; skip counts the enclosing branches that are not taken, in
+// which assignments and errors such as division by zero are ignored.
+type arith struct {
+	expr  string
+	toks  []string
+	pos   int
+	vars  *Variables
+	skip  int
+	depth int
+}
+
+// evalArith evaluates an arithmetic expression with variables from vars
+func evalArith(expr string, vars *Variables) (int64, error) {
+	return evalArithDepth(expr, vars, 0)
+}
+
+func evalArithDepth(expr string, vars *Variables, depth int) (int64, error) {
+	if depth > maxArithDepth {
+		return 0, fmt.Errorf("%s: expression recursion level exceeded", strings.TrimSpace(expr))
+	}
+
+	toks, err := tokenizeArith(expr)
+	if err != nil {
+		return 0, err
+	}
+	if len(toks) == 0 {
+		return 0, nil
+	}
+
+	a := &arith{expr: expr, toks: toks, vars: vars, depth: depth}
+	v, err := a.comma()
+	if err != nil {
+		return 0, err
+	}
+	if a.pos < len(a.toks) {
+		return 0, a.syntaxError("syntax error in expression")
+	}
+	return v, nil
+}
+
+// tokenizeArith splits an expression into numbers, names and operators
+func tokenizeArith(expr string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case isNameChar(expr, i):
+			// numbers may contain letters, as in 0xff or 64#Zz@
+			start := i
+			number := c >= '0' && c <= '9'
+			for i < len(expr) && (isNameChar(expr, i) || (number && (expr[i] == '#' || expr[i] == '@'))) {
+				i++
+			}
+			toks = append(toks, expr[start:i])
+		default:
+			op := ""
+			for _, candidate := range arithOps {
+				if strings.HasPrefix(expr[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("%s: syntax error: invalid arithmetic operator (error token is %q)",
+					strings.TrimSpace(expr), expr[i:])
+			}
+			toks = append(toks, op)
+			i += len(op)
+		}
+	}
+	return toks, nil
+}
+
+func (a *arith) peek() string {
+	if a.pos < len(a.toks) {
+		return a.toks[a.pos]
+	}
+	return ""
+}
+
+func (a *arith) next() string {
+	tok := a.peek()
+	a.pos++
+	return tok
+}
+
+// rest returns the unparsed remainder of the expression
+func (a *arith) rest() string {
+	if a.pos >= len(a.toks) {
+		return ""
+	}
+	return strings.Join(a.toks[a.pos:], " ")
+}
+
+func (a *arith) syntaxError(msg string) error {
+	return fmt.Errorf("%s: %s (error token is %q)", strings.TrimSpace(a.expr), msg, a.rest())
+}
+
+func (a *arith) fail(msg string) error {
+	return fmt.Errorf("%s: %s", strings.TrimSpace(a.expr), msg)
+}
+
+// comma parses expr , expr ...
+func (a *arith) comma() (int64, error) {
+	v, err := a.assign()
+	for err == nil && a.peek() == "," {
+		a.next()
+		v, err = a.assign()
+	}
+	return v, err
+}
+
+// assign parses name op= expr, or a conditional expression
+func (a *arith) assign() (int64, error) {
+	if a.pos+1 < len(a.toks) && isName(a.toks[a.pos]) {
+		op := a.toks[a.pos+1]
+		if isAssignOp(op) {
+			name := a.next()
+			a.next()
+
+			r, err := a.assign()
+			if err != nil {
+				return 0, err
+			}
+			v := r
+			if op != "=" {
+				l, err := a.variable(name)
+				if err != nil {
+					return 0, err
+				}
+				if v, err = a.binary(strings.TrimSuffix(op, "="), l, r); err != nil {
+					return 0, err
+				}
+			}
+			return v, a.setVariable(name, v)
+		}
+	}
+	return a.conditional()
+}
+
+func isAssignOp(op string) bool {
+	switch op {
+	case "=", "+=", "-=", "*=", "/=", "%=", "<<=", ">>=", "&=", "^=", "|=":
+		return true
+	}
+	return false
+}
+
+// conditional parses cond ? expr : expr
+func (a *arith) conditional() (int64, error) {
+	c, err := a.binaryLevel(0)
+	if err != nil || a.peek() != "?" {
+		return c, err
+	}
+	a.next()
+
+	t, err := a.branch(c != 0, a.comma)
+	if err != nil {
+		return 0, err
+	}
+	if a.next() != ":" {
+		a.pos--
+		return 0, a.syntaxError("syntax error: `:' expected for conditional expression")
+	}
+	f, err := a.branch(c == 0, a.assign)
+	if err != nil {
+		return 0, err
+	}
+
+	if c != 0 {
+		return t, nil
+	}
+	return f, nil
+}
+
+// branch parses an operand that is only evaluated if taken
+func (a *arith) branch(taken bool, parse func() (int64, error)) (int64, error) {
+	if !taken {
+		a.skip++
+		defer func() { a.skip-- }()
+	}
+	return parse()
+}
+
+// binaryLevel parses the binary operators of arithLevels[level] and
+// everything that binds tighter
+func (a *arith) binaryLevel(level int) (int64, error) {
+	if level == len(arithLevels) {
+		return a.power()
+	}
+
+	l, err := a.binaryLevel(level + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op := a.peek()
+		if !containsOp(arithLevels[level], op) {
+			return l, nil
+		}
+		a.next()
+
+		// && and || do not evaluate their right operand when the left
+		// one already decides the result
+		taken := !(op == "&&" && l == 0) && !(op == "||" && l != 0)
+		r, err := a.branch(taken, func() (int64, error) { return a.binaryLevel(level + 1) })
+		if err != nil {
+			return 0, err
+		}
+		if l, err = a.binary(op, l, r); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func containsOp(ops []string, op string) bool {
+	for _, o := range ops {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// power parses the right associative ** operator
+func (a *arith) power() (int64, error) {
+	b, err := a.unary()
+	if err != nil || a.peek() != "**" {
+		return b, err
+	}
+	a.next()
+
+	exp, err := a.power()
+	if err != nil {
+		return 0, err
+	}
+	return a.binary("**", b, exp)
+}
+
+// unary parses the prefix operators
+func (a *arith) unary() (int64, error) {
+	switch op := a.peek(); op {
+	case "++", "--":
+		a.next()
+		name := a.next()
+		if !isName(name) {
+			a.pos--
+			return 0, a.syntaxError("syntax error: operand expected")
+		}
+		v, err := a.variable(name)
+		if err != nil {
+			return 0, err
+		}
+		if op == "++" {
+			v++
+		} else {
+			v--
+		}
+		return v, a.setVariable(name, v)
+	case "!", "~", "-", "+":
+		a.next()
+		v, err := a.unary()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "!":
+			return boolInt(v == 0), nil
+		case "~":
+			return ^v, nil
+		case "-":
+			return -v, nil
+		}
+		return v, nil
+	}
+	return a.postfix()
+}
+
+// postfix parses operands, including name++ and name--
+func (a *arith) postfix() (int64, error) {
+	tok := a.next()
+	switch {
+	case tok == "(":
+		v, err := a.comma()
+		if err != nil {
+			return 0, err
+		}
+		if a.next() != ")" {
+			a.pos--
+			return 0, a.syntaxError("missing `)'")
+		}
+		return v, nil
+	case tok == "":
+		return 0, a.syntaxError("syntax error: operand expected")
+	case tok[0] >= '0' && tok[0] <= '9':
+		v, err := parseArithNumber(tok)
+		if err != nil {
+			a.pos--
+			return 0, a.syntaxError(err.Error())
+		}
+		return v, nil
+	case isName(tok):
+		v, err := a.variable(tok)
+		if err != nil {
+			return 0, err
+		}
+		if op := a.peek(); op == "++" || op == "--" {
+			a.next()
+			n := v + 1
+			if op == "--" {
+				n = v - 1
+			}
+			return v, a.setVariable(tok, n)
+		}
+		return v, nil
+	}
+
+	a.pos--
+	return 0, a.syntaxError("syntax error: operand expected")
+}
+
+// binary applies a binary operator
+func (a *arith) binary(op string, l, r int64) (int64, error) {
+	switch op {
+	case "+":
+		return l + r, nil
+	case "-":
+		return l - r, nil
+	case "*":
+		return l * r, nil
+	case "/", "%":
+		if r == 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, a.fail("division by 0")
+		}
+		if op == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	case "**":
+		if r < 0 {
+			if a.skip > 0 {
+				return 0, nil
+			}
+			return 0, a.fail("exponent less than 0")
+		}
+		// exponentiation by squaring, so huge exponents stay fast; the
+		// result wraps around like the other operators
+		result := int64(1)
+		for ; r > 0; r >>= 1 {
+			if r&1 == 1 {
+				result *= l
+			}
+			l *= l
+		}
+		return result, nil
+	case "<<":
+		return l << uint64(r), nil
+	case ">>":
+		return l >> uint64(r), nil
+	case "&":
+		return l & r, nil
+	case "|":
+		return l | r, nil
+	case "^":
+		return l ^ r, nil
+	case "&&":
+		return boolInt(l != 0 && r != 0), nil
+	case "||":
+		return boolInt(l != 0 || r != 0), nil
+	case "==":
+		return boolInt(l == r), nil
+	case "!=":
+		return boolInt(l != r), nil
+	case "<":
+		return boolInt(l < r), nil
+	case ">":
+		return boolInt(l > r), nil
+	case "<=":
+		return boolInt(l <= r), nil
+	case ">=":
+		return boolInt(l >= r), nil
+	}
+	return 0, a.syntaxError("syntax error in expression")
+}
+
+// variable returns the value of a variable. Unset and empty variables
+// are 0, and a value that is not a number is evaluated as an expression.
+func (a *arith) variable(name string) (int64, error) {
+	value, _ := a.vars.Get(name)
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if v, err := parseArithNumber(value); err == nil {
+		return v, nil
+	}
+	return evalArithDepth(value, a.vars, a.depth+1)
+}
+
+func (a *arith) setVariable(name string, v int64) error {
+	if a.skip > 0 {
+		return nil
+	}
+	return a.vars.Set(name, strconv.FormatInt(v, 10))
+}
+
+// parseArithNumber parses an integer constant: decimal, octal with a
+// leading 0, hexadecimal with 0x, or base#digits for bases 2 to 64
+func parseArithNumber(tok string) (int64, error) {
+	base := 10
+	digits := tok
+	switch {
+	case strings.Contains(tok, "#"):
+		b, rest, _ := strings.Cut(tok, "#")
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 2 || n > 64 {
+			return 0, fmt.Errorf("invalid arithmetic base")
+		}
+		base, digits = n, rest
+	case strings.HasPrefix(tok, "0x") || strings.HasPrefix(tok, "0X"):
+		base, digits = 16, tok[2:]
+	case len(tok) > 1 && tok[0] == '0':
+		base, digits = 8, tok[1:]
+	}
+
+	if digits == "" {
+		return 0, fmt.Errorf("invalid number")
+	}
+
+	var v int64
+	for i := 0; i < len(digits); i++ {
+		d := digitValue(digits[i], base)
+		if d < 0 || d >= base {
+			return 0, fmt.Errorf("value too great for base")
+		}
+		v = v*int64(base) + int64(d)
+	}
+	return v, nil
+}
+
+// digitValue returns the value of a digit in the bash digit set
+// 0-9, a-z, A-Z, @ and _. Below base 37 letters are case insensitive.
+func digitValue(c byte, base int) int {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0')
+	case c >= 'a' && c <= 'z':
+		return int(c-'a') + 10
+	case c >= 'A' && c <= 'Z':
+		if base <= 36 {
+			return int(c-'A') + 10
+		}
+		return int(c-'A') + 36
+	case c == '@':
+		return 62
+	case c == '_':
+		return 63
+	}
+	return -1
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,115 @@
+package main
+
+// List is a sequence of and-or lists separated by ;, & or newlines
+type List struct {
+	Items []*ListItem
+}
+
+// ListItem is one entry of a List. Background items were terminated
+// by & and do not block the items that follow.
+type ListItem struct {
+	AndOr      *AndOr
+	Background bool
+}
+
+// AndOr is a chain of pipelines joined by && and ||. Ops[i] is the
+// operator between Pipelines[i] and Pipelines[i+1].
+type AndOr struct {
+	Pipelines []*Pipeline
+	Ops       []TokenKind
+}
+
+// Pipeline is one or more commands joined by |
+type Pipeline struct {
+	Commands []CommandNode
+}
+
+// CommandNode is a single stage of a pipeline
+type CommandNode interface {
+	commandNode()
+}
+
+// SimpleCommand is a list of words with optional redirections.
+// Assigns holds the NAME=value words that precede the command name.
+type SimpleCommand struct {
+	Assigns   []Token
+	Args      []Token
+	Redirects []*Redirect
+}
+
+// ArithCommand is an arithmetic command ((expr)). It succeeds when the
+// expression evaluates to a non-zero value.
+type ArithCommand struct {
+	Expr      string
+	Redirects []*Redirect
+}
+
+// IfCommand is if/elif/else/fi. Bodies[i] runs when Conds[i] is the
+// first condition to succeed, Else when none does.
+type IfCommand struct {
+	Conds     []*List
+	Bodies    []*List
+	Else      *List
+	Redirects []*Redirect
+}
+
+// LoopCommand is a while loop, or an until loop when Until is set
+type LoopCommand struct {
+	Until     bool
+	Cond      *List
+	Body      *List
+	Redirects []*Redirect
+}
+
+// ForCommand is for name in words; do ...; done. Without the in part
+// the loop runs over the positional parameters.
+type ForCommand struct {
+	Name      string
+	Words     []Token
+	Body      *List
+	Redirects []*Redirect
+}
+
+// ArithForCommand is for ((init; cond; step)); do ...; done. An empty
+// condition is always true.
+type ArithForCommand struct {
+	Init, Cond, Step string
+	Body             *List
+	Redirects        []*Redirect
+}
+
+// CaseCommand is case word in pattern) ...;; esac
+type CaseCommand struct {
+	Word      Token
+	Items     []*CaseItem
+	Redirects []*Redirect
+}
+
+// CaseItem is one clause of a case command: the body runs when the
+// word matches any of the patterns
+type CaseItem struct {
+	Patterns []Token
+	Body     *List
+}
+
+// GroupCommand is a list run as one command, { ...; }
+type GroupCommand struct {
+	Body      *List
+	Redirects []*Redirect
+}
+
+// Redirect is a redirection operator together with its target word
+type Redirect struct {
+	Op     TokenKind
+	Fd     int
+	Target Token
+}
+
+func (*SimpleCommand) commandNode()   {}
+func (*ArithCommand) commandNode()    {}
+func (*IfCommand) commandNode()       {}
+func (*LoopCommand) commandNode()     {}
+func (*ForCommand) commandNode()      {}
+func (*ArithForCommand) commandNode() {}
+func (*CaseCommand) commandNode()     {}
+func (*GroupCommand) commandNode()    {}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expandBraces performs brace expansion on the raw text of a word:
+// a{b,c}d becomes abd acd and {1..3} becomes 1 2 3. Braces that are
+// quoted, escaped or part of a parameter expansion are left alone, as
+// is a pair of braces that contains neither a comma nor a sequence.
+func expandBraces(word string) []string {
+	for i := 0; i < len(word); {
+		switch word[i] {
+		case '\\':
+			i += 2
+		case '\'':
+			i = skipSingleQuoted(word, i)
+		case '"':
+			i = skipDoubleQuoted(word, i)
+		case '`':
+			i = skipBackquoted(word, i)
+		case '$':
+			i = skipDollar(word, i, false)
+		case '{':
+			items, end, ok := braceItems(word, i)
+			if !ok {
+				i++
+				continue
+			}
+			// the items and the rest of the word may hold further braces
+			var words []string
+			for _, item := range items {
+				words = append(words, expandBraces(word[:i]+item+word[end:])...)
+			}
+			return words
+		default:
+			i++
+		}
+	}
+	return []string{word}
+}
+
+// braceItems parses the brace expression that starts at word[i] and
+// returns its items and the index just past the closing brace
+func braceItems(word string, i int) ([]string, int, bool) {
+	depth := 0
+	start := i + 1
+	var items []string
+
+	for j := i + 1; j < len(word); {
+		switch word[j] {
+		case '\\':
+			j += 2
+			continue
+		case '\'':
+			j = skipSingleQuoted(word, j)
+			continue
+		case '"':
+			j = skipDoubleQuoted(word, j)
+			continue
+		case '`':
+			j = skipBackquoted(word, j)
+			continue
+		case '$':
+			j = skipDollar(word, j, false)
+			continue
+		case '{':
+			depth++
+		case ',':
+			if depth == 0 {
+				items = append(items, word[start:j])
+				start = j + 1
+			}
+		case '}':
+			if depth > 0 {
+				depth--
+				break
+			}
+			if items != nil {
+				return append(items, word[start:j]), j + 1, true
+			}
+			seq, ok := braceSequence(word[i+1 : j])
+			return seq, j + 1, ok
+		}
+		j++
+	}
+	return nil, 0, false
+}
+
+// braceSequence expands the body of a sequence expression, x..y or
+// x..y..incr, where x and y are both integers or both single letters
+func braceSequence(body string) ([]string, bool) {
+	parts := strings.Split(body, "..")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, false
+	}
+
+	incr := 1
+	if len(parts) == 3 {
+		n, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, false
+		}
+		// the direction always follows from the two ends
+		incr = max(n, -n, 1)
+	}
+
+	if isLetter(parts[0]) && isLetter(parts[1]) {
+		var seq []string
+		for _, c := range sequence(int(parts[0][0]), int(parts[1][0]), incr) {
+			seq = append(seq, string(rune(c)))
+		}
+		return seq, true
+	}
+
+	first, err1 := strconv.Atoi(parts[0])
+	last, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return nil, false
+	}
+
+	// a leading zero on either end pads every number to the same width
+	width := 0
+	if isZeroPadded(parts[0]) || isZeroPadded(parts[1]) {
+		width = max(len(parts[0]), len(parts[1]))
+	}
+
+	var seq []string
+	for _, n := range sequence(first, last, incr) {
+		seq = append(seq, fmt.Sprintf("%0*d", width, n))
+	}
+	return seq, true
+}
+
+// sequence returns first, first±incr, ... up to and including last
+func sequence(first, last, incr int) []int {
+	var seq []int
+	if first <= last {
+		for n := first; n <= last; n += incr {
+			seq = append(seq, n)
+		}
+	} else {
+		for n := first; n >= last; n -= incr {
+			seq = append(seq, n)
+		}
+	}
+	return seq
+}
+
+func isLetter(s string) bool {
+	return len(s) == 1 && (s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z')
+}
+
+func isZeroPadded(s string) bool {
+	s = strings.TrimPrefix(s, "-")
+	return len(s) > 1 && s[0] == '0'
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 )
@@ -19,23 +21,48 @@ type BuiltinCommands struct {
 	commands   map[string]Command
 	pathFinder *PathFinder
 	history    *History
+	state      *ShellState
+}
+
+// statusError makes a builtin finish with the given status without
+// printing an error message
+type statusError int
+
+func (s statusError) Error() string {
+	return fmt.Sprintf("exit status %d", int(s))
+}
+
+// exitError is returned by exit in a subshell. Instead of ending the
+// process it makes the executor skip the rest of the subshell.
+type exitError int
+
+func (s exitError) Error() string {
+	return fmt.Sprintf("exit %d", int(s))
 }
 
 // NewBuiltinCommands creates a new BuiltinCommands instance
-func NewBuiltinCommands(pf *PathFinder, hist *History) *BuiltinCommands {
+func NewBuiltinCommands(pf *PathFinder, hist *History, state *ShellState) *BuiltinCommands {
 	bc := &BuiltinCommands{
 		commands:   make(map[string]Command),
 		pathFinder: pf,
 		history:    hist,
+		state:      state,
 	}
 
 	// Register all builtin commands
 	bc.register(&EchoCommand{})
 	bc.register(&TypeCommand{pathFinder: pf, builtins: bc})
-	bc.register(&PwdCommand{})
-	bc.register(&CdCommand{})
-	bc.register(&ExitCommand{history: hist})
+	bc.register(&PwdCommand{state: state})
+	bc.register(&CdCommand{state: state})
+	bc.register(&ExitCommand{history: hist, state: state})
 	bc.register(&HistoryCommand{history: hist})
+	bc.register(&SetCommand{state: state})
+	bc.register(&ShoptCommand{state: state})
+	bc.register(&ExportCommand{state: state})
+	bc.register(&ReadonlyCommand{state: state})
+	bc.register(&DeclareCommand{state: state})
+	bc.register(&UnsetCommand{state: state})
+	bc.register(&ReadCommand{state: state})
 
 	return bc
 }
@@ -111,12 +138,14 @@ func (c *TypeCommand) Execute(args []string, stdin io.Reader, stdout io.Writer)
 }
 
 // PwdCommand implements the pwd builtin
-type PwdCommand struct{}
+type PwdCommand struct {
+	state *ShellState
+}
 
 func (c *PwdCommand) Name() string { return "pwd" }
 
 func (c *PwdCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
-	cwd, err := os.Getwd()
+	cwd, err := c.state.WorkDir()
 	if err != nil {
 		return fmt.Errorf("pwd: %v", err)
 	}
@@ -125,40 +154,50 @@ func (c *PwdCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) e
 }
 
 // CdCommand implements the cd builtin
-type CdCommand struct{}
+type CdCommand struct {
+	state *ShellState
+}
 
 func (c *CdCommand) Name() string { return "cd" }
 
 func (c *CdCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
 	targetDir := ""
 
-	if len(args) == 0 || args[0] == "~" {
+	if len(args) == 0 {
 		// go to home directory
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return fmt.Errorf("cd: %v", err)
+		homeDir, ok := c.state.Vars.Get("HOME")
+		if !ok {
+			return fmt.Errorf("cd: HOME not set")
 		}
 		targetDir = homeDir
 	} else {
 		targetDir = args[0]
 	}
 
-	if err := os.Chdir(targetDir); err != nil {
+	oldDir, _ := c.state.WorkDir()
+	if err := c.state.Chdir(targetDir); err != nil {
 		return fmt.Errorf("cd: %s: No such file or directory", targetDir)
 	}
 
+	// keep PWD and OLDPWD up to date for ~+ and ~-
+	if newDir, err := c.state.WorkDir(); err == nil {
+		c.state.Vars.Set("OLDPWD", oldDir)
+		c.state.Vars.Set("PWD", newDir)
+	}
 	return nil
 }
 
 // ExitCommand implements the exit builtin
 type ExitCommand struct {
 	history *History
+	state   *ShellState
 }
 
 func (c *ExitCommand) Name() string { return "exit" }
 
 func (c *ExitCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
-	exitCode := 0
+	// without an argument exit with the status of the last command
+	exitCode := c.state.LastStatus
 
 	if len(args) > 0 {
 		code, err := strconv.Atoi(args[0])
@@ -170,6 +209,10 @@ func (c *ExitCommand) Execute(args []string, stdin io.Reader, stdout io.Writer)
 		}
 	}
 
+	if c.state.Subshell {
+		return exitError(exitCode)
+	}
+
 	// write history to history file
 	c.history.WriteToFile()
 
@@ -216,6 +259,519 @@ func (c *HistoryCommand) Execute(args []string, stdin io.Reader, stdout io.Write
 		}
 	}
 
-	c.history.Get()
+	c.history.Get(stdout)
+	return nil
+}
+
+// SetCommand implements the set builtin for shell options
+type SetCommand struct {
+	state *ShellState
+}
+
+func (c *SetCommand) Name() string { return "set" }
+
+func (c *SetCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	// set -o / set +o without a name lists the options
+	if len(args) == 0 || (len(args) == 1 && (args[0] == "-o" || args[0] == "+o")) {
+		for _, name := range setOptions {
+			if len(args) == 1 && args[0] == "+o" {
+				flag := "+o"
+				if c.state.Options[name] {
+					flag = "-o"
+				}
+				fmt.Fprintf(stdout, "set %s %s\n", flag, name)
+				continue
+			}
+			value := "off"
+			if c.state.Options[name] {
+				value = "on"
+			}
+			fmt.Fprintf(stdout, "%-15s\t%s\n", name, value)
+		}
+		return nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		flag := args[i]
+		if flag != "-o" && flag != "+o" {
+			return fmt.Errorf("set: %s: invalid option", flag)
+		}
+		if i+1 >= len(args) {
+			return fmt.Errorf("set: %s: option name required", flag)
+		}
+		i++
+
+		name := args[i]
+		if !slices.Contains(setOptions, name) {
+			return fmt.Errorf("set: %s: invalid option name", name)
+		}
+		c.state.Options[name] = flag == "-o"
+	}
+
+	return nil
+}
+
+// ShoptCommand implements the shopt builtin for the options that are
+// not managed by set -o
+type ShoptCommand struct {
+	state *ShellState
+}
+
+func (c *ShoptCommand) Name() string { return "shopt" }
+
+func (c *ShoptCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	flags, _, names, err := parseVarFlags("shopt", args, "spqu")
+	if err != nil {
+		return err
+	}
+	if strings.Contains(flags, "s") && strings.Contains(flags, "u") {
+		return fmt.Errorf("shopt: cannot set and unset shell options simultaneously")
+	}
+
+	for _, name := range names {
+		if !slices.Contains(shoptOptions, name) {
+			return fmt.Errorf("shopt: %s: invalid shell option name", name)
+		}
+	}
+
+	// -s and -u without names list the options that are set or unset
+	if strings.ContainsAny(flags, "su") && len(names) > 0 {
+		for _, name := range names {
+			c.state.Options[name] = strings.Contains(flags, "s")
+		}
+		return nil
+	}
+
+	if len(names) == 0 {
+		names = shoptOptions
+	}
+
+	unset := 0
+	for _, name := range names {
+		on := c.state.Options[name]
+		if !on {
+			unset++
+		}
+		switch {
+		case strings.Contains(flags, "s") && !on, strings.Contains(flags, "u") && on:
+			continue
+		case strings.Contains(flags, "q"):
+		case strings.Contains(flags, "p"):
+			flag := "-u"
+			if on {
+				flag = "-s"
+			}
+			fmt.Fprintf(stdout, "shopt %s %s\n", flag, name)
+		default:
+			value := "off"
+			if on {
+				value = "on"
+			}
+			fmt.Fprintf(stdout, "%-15s\t%s\n", name, value)
+		}
+	}
+
+	// shopt -q reports through its status whether all names are set
+	if strings.Contains(flags, "q") && unset > 0 {
+		return statusError(1)
+	}
 	return nil
 }
+
+// parseVarFlags splits the leading options of the variable builtins
+// from their operands. Options given with - are returned in on and
+// those given with + in off.
+func parseVarFlags(builtin string, args []string, valid string) (on, off string, operands []string, err error) {
+	for len(args) > 0 {
+		arg := args[0]
+		if arg == "--" {
+			args = args[1:]
+			break
+		}
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			break
+		}
+		for _, flag := range arg[1:] {
+			if !strings.ContainsRune(valid, flag) {
+				return "", "", nil, fmt.Errorf("%s: %c%c: invalid option", builtin, arg[0], flag)
+			}
+			if arg[0] == '-' {
+				on += string(flag)
+			} else {
+				off += string(flag)
+			}
+		}
+		args = args[1:]
+	}
+	return on, off, args, nil
+}
+
+// printVariables lists the variables accepted by filter in the form of
+// declare -p, which can be read back by the shell
+func printVariables(vars *Variables, stdout io.Writer, filter func(Variable) bool) {
+	for _, name := range vars.Names() {
+		if v, ok := vars.Lookup(name); ok && filter(v) {
+			fmt.Fprintln(stdout, declareLine(name, v))
+		}
+	}
+}
+
+// declareLine formats a variable as a declare command
+func declareLine(name string, v Variable) string {
+	flags := ""
+	if v.ReadOnly {
+		flags += "r"
+	}
+	if v.Exported {
+		flags += "x"
+	}
+	if flags == "" {
+		flags = "-"
+	}
+
+	line := fmt.Sprintf("declare -%s %s", flags, name)
+	if v.HasValue {
+		line += "=" + quoteDeclare(v.Value)
+	}
+	return line
+}
+
+// quoteDeclare double-quotes a value, escaping the characters that are
+// special inside double quotes
+func quoteDeclare(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range value {
+		if strings.ContainsRune("\"\\$`", c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// assignVariables handles the NAME[=value] operands of the variable
+// builtins: it assigns the value if one is given and then applies
+// attrs to the variable. Errors are collected so that the remaining
+// operands are still processed.
+func assignVariables(builtin string, vars *Variables, operands []string, attrs func(name string)) error {
+	var errs []error
+	for _, operand := range operands {
+		name, value, hasValue := strings.Cut(operand, "=")
+		if !isName(name) {
+			errs = append(errs, fmt.Errorf("%s: `%s': not a valid identifier", builtin, operand))
+			continue
+		}
+		if hasValue {
+			if err := vars.Set(name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", builtin, err))
+				continue
+			}
+		}
+		attrs(name)
+	}
+	return errors.Join(errs...)
+}
+
+// ExportCommand implements the export builtin
+type ExportCommand struct {
+	state *ShellState
+}
+
+func (c *ExportCommand) Name() string { return "export" }
+
+func (c *ExportCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	on, _, operands, err := parseVarFlags("export", args, "np")
+	if err != nil {
+		return err
+	}
+
+	if len(operands) == 0 {
+		printVariables(c.state.Vars, stdout, func(v Variable) bool { return v.Exported })
+		return nil
+	}
+
+	// export -n removes the export attribute but keeps the variable
+	exported := !strings.Contains(on, "n")
+	return assignVariables("export", c.state.Vars, operands, func(name string) {
+		c.state.Vars.SetExported(name, exported)
+	})
+}
+
+// ReadonlyCommand implements the readonly builtin
+type ReadonlyCommand struct {
+	state *ShellState
+}
+
+func (c *ReadonlyCommand) Name() string { return "readonly" }
+
+func (c *ReadonlyCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	_, _, operands, err := parseVarFlags("readonly", args, "p")
+	if err != nil {
+		return err
+	}
+
+	if len(operands) == 0 {
+		printVariables(c.state.Vars, stdout, func(v Variable) bool { return v.ReadOnly })
+		return nil
+	}
+
+	return assignVariables("readonly", c.state.Vars, operands, c.state.Vars.SetReadOnly)
+}
+
+// DeclareCommand implements the declare builtin. -p prints variables,
+// -x and +x set and clear the export attribute, -r makes them read-only.
+type DeclareCommand struct {
+	state *ShellState
+}
+
+func (c *DeclareCommand) Name() string { return "declare" }
+
+func (c *DeclareCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	on, off, operands, err := parseVarFlags("declare", args, "prx")
+	if err != nil {
+		return err
+	}
+	vars := c.state.Vars
+
+	if len(operands) == 0 {
+		printVariables(vars, stdout, func(v Variable) bool {
+			return (!strings.Contains(on, "x") || v.Exported) && (!strings.Contains(on, "r") || v.ReadOnly)
+		})
+		return nil
+	}
+
+	if strings.Contains(on, "p") {
+		var errs []error
+		for _, name := range operands {
+			v, ok := vars.Lookup(name)
+			if !ok {
+				errs = append(errs, fmt.Errorf("declare: %s: not found", name))
+				continue
+			}
+			fmt.Fprintln(stdout, declareLine(name, v))
+		}
+		return errors.Join(errs...)
+	}
+
+	return assignVariables("declare", vars, operands, func(name string) {
+		switch {
+		case strings.Contains(on, "x"):
+			vars.SetExported(name, true)
+		case strings.Contains(off, "x"):
+			vars.SetExported(name, false)
+		}
+		if strings.Contains(on, "r") {
+			vars.SetReadOnly(name)
+		}
+	})
+}
+
+// UnsetCommand implements the unset builtin for variables
+type UnsetCommand struct {
+	state *ShellState
+}
+
+func (c *UnsetCommand) Name() string { return "unset" }
+
+func (c *UnsetCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	on, _, operands, err := parseVarFlags("unset", args, "fv")
+	if err != nil {
+		return err
+	}
+	// there are no shell functions to unset
+	if strings.Contains(on, "f") {
+		return nil
+	}
+
+	var errs []error
+	for _, name := range operands {
+		if !isName(name) {
+			errs = append(errs, fmt.Errorf("unset: `%s': not a valid identifier", name))
+			continue
+		}
+		if err := c.state.Vars.Unset(name); err != nil {
+			errs = append(errs, fmt.Errorf("unset: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BreakCommand implements the break and continue builtins. break N
+// leaves the N innermost loops; continue N leaves N-1 of them and
+// resumes the next iteration of the Nth.
+type BreakCommand struct {
+	name  string
+	loops *loopControl
+}
+
+func (c *BreakCommand) Name() string { return c.name }
+
+func (c *BreakCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	n := 1
+	if len(args) > 0 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("%s: %s: numeric argument required", c.name, args[0])
+		}
+		if v < 1 {
+			return fmt.Errorf("%s: %s: loop count out of range", c.name, args[0])
+		}
+		n = v
+	}
+
+	if c.loops.depth == 0 {
+		return fmt.Errorf("%s: only meaningful in a `for', `while', or `until' loop", c.name)
+	}
+	// a count beyond the number of loops leaves all of them
+	n = min(n, c.loops.depth)
+
+	if c.name == "break" {
+		c.loops.breaks = n
+	} else {
+		c.loops.continues = n
+	}
+	return nil
+}
+
+// ReadCommand implements the read builtin. It reads a line from stdin
+// and splits it at the characters of IFS into the named variables, the
+// last of which takes the rest of the line. Without names the whole
+// line goes to REPLY. A backslash quotes the next character unless -r
+// is given. The status is 1 at end of input.
+type ReadCommand struct {
+	state *ShellState
+}
+
+func (c *ReadCommand) Name() string { return "read" }
+
+func (c *ReadCommand) Execute(args []string, stdin io.Reader, stdout io.Writer) error {
+	on, _, names, err := parseVarFlags("read", args, "r")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !isName(name) {
+			return fmt.Errorf("read: `%s': not a valid identifier", name)
+		}
+	}
+
+	line, escaped, eof := readLine(stdin, strings.Contains(on, "r"))
+
+	var values []string
+	if len(names) == 0 {
+		names = []string{"REPLY"}
+		values = []string{string(line)}
+	} else {
+		ifs, ok := c.state.Vars.Get("IFS")
+		if !ok {
+			ifs = defaultIFS
+		}
+		values = splitRead(line, escaped, ifs, len(names))
+	}
+
+	var errs []error
+	for i, name := range names {
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		if err := c.state.Vars.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("read: %v", err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if eof {
+		return statusError(1)
+	}
+	return nil
+}
+
+// readLine reads a line from r one byte at a time, so that the input
+// after it is left for the next command. Unless raw is set, a
+// backslash quotes the next byte, which escaped marks, and a backslash-
+// newline continues the line. eof reports that the input ended before
+// a newline.
+func readLine(r io.Reader, raw bool) (line []byte, escaped []bool, eof bool) {
+	buf := make([]byte, 1)
+	quoteNext := false
+
+	for {
+		n, err := r.Read(buf)
+		if n == 0 {
+			if err != nil {
+				return line, escaped, true
+			}
+			continue
+		}
+
+		c := buf[0]
+		switch {
+		case quoteNext:
+			quoteNext = false
+			if c != '\n' {
+				line = append(line, c)
+				escaped = append(escaped, true)
+			}
+		case c == '\\' && !raw:
+			quoteNext = true
+		case c == '\n':
+			return line, escaped, false
+		default:
+			line = append(line, c)
+			escaped = append(escaped, false)
+		}
+	}
+}
+
+// splitRead splits a line for read into at most n fields at the
+// unescaped characters of ifs. As in field splitting, runs of IFS
+// whitespace separate fields and are dropped at the ends. The last
+// field takes the rest of the line.
+func splitRead(line []byte, escaped []bool, ifs string, n int) []string {
+	isSep := func(i int) bool {
+		return !escaped[i] && strings.IndexByte(ifs, line[i]) >= 0
+	}
+	isSpace := func(i int) bool {
+		return isSep(i) && isIFSSpace(rune(line[i]))
+	}
+
+	var fields []string
+	i := 0
+	for i < len(line) && isSpace(i) {
+		i++
+	}
+
+	for len(fields) < n-1 && i < len(line) {
+		start := i
+		for i < len(line) && !isSep(i) {
+			i++
+		}
+		fields = append(fields, string(line[start:i]))
+
+		// a separator is one IFS character other than whitespace,
+		// with any IFS whitespace around it
+		for i < len(line) && isSpace(i) {
+			i++
+		}
+		if i < len(line) && isSep(i) {
+			i++
+			for i < len(line) && isSpace(i) {
+				i++
+			}
+		}
+	}
+
+	if i < len(line) {
+		end := len(line)
+		for end > i && isSpace(end-1) {
+			end--
+		}
+		fields = append(fields, string(line[i:end]))
+	}
+	return fields
+}
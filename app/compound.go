@@ -0,0 +1,184 @@
+package main
+
+import "strings"
+
+// loopControl keeps track of the loops an executor is running. Each
+// subshell has its own, so break and continue only reach the loops of
+// the subshell they run in.
+type loopControl struct {
+	// depth is the number of loops currently running
+	depth int
+	// breaks and continues count the enclosing loops that break and
+	// continue still have to leave before execution resumes
+	breaks    int
+	continues int
+}
+
+// withRedirects applies the redirections of a compound command for as
+// long as run executes its body
+func (e *Executor) withRedirects(redirects []*Redirect, fds fdTable, run func(fdTable) int) int {
+	cmdFds, opened, err := e.applyRedirects(fds, redirects)
+	if err != nil {
+		return fds.fail(err, 1)
+	}
+	defer closeFiles(opened)
+	defer e.useFds(cmdFds)()
+
+	return run(cmdFds)
+}
+
+// runIf runs the body of the first condition that succeeds, or the else
+// part. Its status is that of the body, or 0 when nothing ran.
+func (e *Executor) runIf(cmd *IfCommand, fds fdTable) int {
+	for i, cond := range cmd.Conds {
+		status := e.runList(cond, fds)
+		if e.unwinding() {
+			return status
+		}
+		if status == 0 {
+			return e.runList(cmd.Bodies[i], fds)
+		}
+	}
+
+	if cmd.Else != nil {
+		return e.runList(cmd.Else, fds)
+	}
+	return 0
+}
+
+// runLoop runs a while or until loop. Its status is that of the last
+// run of the body, or 0 when the body never ran.
+func (e *Executor) runLoop(cmd *LoopCommand, fds fdTable) int {
+	e.loops.depth++
+	defer func() { e.loops.depth-- }()
+
+	status := 0
+	for {
+		cond := e.runList(cmd.Cond, fds)
+		if e.unwinding() {
+			if e.endIteration() {
+				break
+			}
+			continue
+		}
+		if (cond == 0) == cmd.Until {
+			break
+		}
+
+		status = e.runList(cmd.Body, fds)
+		if e.endIteration() {
+			break
+		}
+	}
+	return status
+}
+
+// runFor runs the body of a for loop once for each field its words
+// expand to
+func (e *Executor) runFor(cmd *ForCommand, fds fdTable) int {
+	words, err := e.expandWords(cmd.Words)
+	if err != nil {
+		return fds.fail(err, 1)
+	}
+
+	e.loops.depth++
+	defer func() { e.loops.depth-- }()
+
+	status := 0
+	for _, word := range words {
+		if err := e.state.Vars.Set(cmd.Name, word); err != nil {
+			return fds.fail(err, 1)
+		}
+		status = e.runList(cmd.Body, fds)
+		if e.endIteration() {
+			break
+		}
+	}
+	return status
+}
+
+// runArithFor runs an arithmetic for loop
+func (e *Executor) runArithFor(cmd *ArithForCommand, fds fdTable) int {
+	if _, err := e.evalLoopExpr(cmd.Init); err != nil {
+		return fds.fail(err, 1)
+	}
+
+	e.loops.depth++
+	defer func() { e.loops.depth-- }()
+
+	status := 0
+	for {
+		v, err := e.evalLoopExpr(cmd.Cond)
+		if err != nil {
+			return fds.fail(err, 1)
+		}
+		if v == 0 {
+			break
+		}
+
+		status = e.runList(cmd.Body, fds)
+		if e.endIteration() {
+			break
+		}
+
+		if _, err := e.evalLoopExpr(cmd.Step); err != nil {
+			return fds.fail(err, 1)
+		}
+	}
+	return status
+}
+
+// evalLoopExpr evaluates an expression of an arithmetic for loop. An
+// empty expression counts as 1, so a missing condition is always true.
+func (e *Executor) evalLoopExpr(expr string) (int64, error) {
+	if strings.TrimSpace(expr) == "" {
+		return 1, nil
+	}
+	return e.evalArith(expr)
+}
+
+// runCase runs the body of the first clause with a pattern that
+// matches the word. Its status is 0 when no pattern matches.
+func (e *Executor) runCase(cmd *CaseCommand, fds fdTable) int {
+	word, err := e.expandWord(cmd.Word)
+	if err != nil {
+		return fds.fail(err, 1)
+	}
+
+	for _, item := range cmd.Items {
+		for _, p := range item.Patterns {
+			pattern, err := e.expandPattern(p.Text)
+			if err != nil {
+				return fds.fail(err, 1)
+			}
+			if matchPattern(pattern, word) {
+				return e.runList(item.Body, fds)
+			}
+		}
+	}
+	return 0
+}
+
+// unwinding reports whether a break or continue is leaving the
+// commands of a loop body, exit those of a subshell, or Ctrl+C those
+// of the command line
+func (e *Executor) unwinding() bool {
+	return e.loops.breaks > 0 || e.loops.continues > 0 || e.state.Exited || e.state.Interrupted
+}
+
+// endIteration settles a pending break or continue at the end of one
+// run of a loop body and reports whether the loop must stop. continue
+// N stops the N-1 innermost loops and goes on with the next one.
+func (e *Executor) endIteration() bool {
+	switch {
+	case e.state.Exited, e.state.Interrupted:
+		return true
+	case e.loops.breaks > 0:
+		e.loops.breaks--
+		return true
+	case e.loops.continues > 0:
+		e.loops.continues--
+		return e.loops.continues > 0
+	}
+	return false
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"syscall"
 )
 
 // Executor handles command execution including external programs,
@@ -13,224 +16,541 @@ import (
 type Executor struct {
 	pathFinder *PathFinder
 	builtins   *BuiltinCommands
+	state      *ShellState
+
+	// loops are the loops this executor is running, which break and
+	// continue act on
+	loops *loopControl
+
+	// fds are the descriptors of the command being run, which its
+	// command substitutions inherit
+	fds fdTable
+
+	// Stdin, Stdout and Stderr are handed to foreground programs. When
+	// they are the terminal, programs inherit it directly, so interactive
+	// and progressively printing programs behave as in any shell. Stderr
+	// is always passed through live; if it is the same writer as Stdout
+	// both streams share one pipe and keep their relative order.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
 }
 
 // NewExecutor creates a new Executor instance
-func NewExecutor(pf *PathFinder, bc *BuiltinCommands) *Executor {
+func NewExecutor(pf *PathFinder, bc *BuiltinCommands, state *ShellState) *Executor {
+	// commands are looked up in the current value of PATH
+	state.Vars.Watch("PATH", pf.SetPath)
+
+	loops := &loopControl{}
+	bc.register(&BreakCommand{name: "break", loops: loops})
+	bc.register(&BreakCommand{name: "continue", loops: loops})
+
 	return &Executor{
 		pathFinder: pf,
 		builtins:   bc,
+		state:      state,
+		loops:      loops,
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
 	}
 }
 
-// Execute runs a command (builtin or external)
-func (e *Executor) Execute(input string) (string, error) {
-	input = strings.TrimSpace(input)
-
-	// Handle pipes
-	if strings.Contains(input, "|") {
-		return "", e.executePipe(input)
+// Execute parses a command line, runs it and returns its exit status.
+// Output goes to the executor's writers exactly as the commands
+// produced it, and the status is recorded in the shell state.
+func (e *Executor) Execute(input string) int {
+	list, err := Parse(input)
+	if err != nil {
+		fmt.Fprintln(e.Stderr, err)
+		var serr *SyntaxError
+		if errors.As(err, &serr) {
+			fmt.Fprintln(e.Stderr, serr.Caret())
+		}
+		e.state.LastStatus = 2
+		return 2
 	}
 
-	parts := ParseArgs(input)
-	if len(parts) == 0 {
-		return "", nil
-	}
+	e.state.Interrupted = false
+	return e.runList(list, newFdTable(e.Stdin, e.Stdout, e.Stderr))
+}
 
-	command := parts[0]
-	args := parts[1:]
+// subshell returns an executor for a subshell. It starts with a copy
+// of the shell's state, and nothing it changes reaches the shell.
+func (e *Executor) subshell() *Executor {
+	state := e.state.subshell()
+	pf := &PathFinder{}
+	path, _ := state.Vars.Get("PATH")
+	pf.SetPath(path)
+
+	sub := NewExecutor(pf, NewBuiltinCommands(pf, e.builtins.history, state), state)
+	sub.Stdin, sub.Stdout, sub.Stderr = e.Stdin, e.Stdout, e.Stderr
+	return sub
+}
 
-	// Check if it's a builtin command (and not redirected)
-	if e.builtins.IsBuiltin(command) && !strings.Contains(input, ">") {
-		var buf bytes.Buffer
-		if err := e.builtins.Execute(command, args, os.Stdin, &buf); err != nil {
-			return "", err
-		}
-		return strings.TrimSuffix(buf.String(), "\n"), nil
+// runSubshell runs the commands of a subshell and returns its status,
+// which exit may have given
+func (e *Executor) runSubshell(run func() int) int {
+	status := run()
+	if e.state.Exited {
+		return e.state.ExitStatus
 	}
-
-	// Execute external command
-	return e.executeExternal(command, args)
+	return status
 }
 
-// executeExternal runs an external program with optional redirection
-func (e *Executor) executeExternal(command string, args []string) (string, error) {
-	fullPath := e.pathFinder.FindExecutable(command)
-	if fullPath == "" {
-		return "", fmt.Errorf("%s: command not found", command)
+// runList runs each item of a list in order and returns the status of
+// the last one. A break, continue or exit skips the rest of the list.
+func (e *Executor) runList(list *List, fds fdTable) int {
+	status := 0
+
+	for _, item := range list.Items {
+		if e.unwinding() {
+			break
+		}
+		if item.Background {
+			// a background job runs in a subshell, so it cannot change
+			// $? or PIPESTATUS once it finishes. It gets its own copies
+			// of the files, which the commands around it may close
+			// before it is done.
+			jobFds, files, err := fds.dup()
+			if err != nil {
+				status = fds.fail(err, 1)
+				e.state.LastStatus = status
+				continue
+			}
+			sub := e.subshell()
+			go func() {
+				defer closeFiles(files)
+				sub.runAndOr(item.AndOr, jobFds)
+			}()
+			status = 0
+			e.state.LastStatus = status
+			continue
+		}
+
+		status = e.runAndOr(item.AndOr, fds)
 	}
 
-	// Check for output redirection
-	redirectType, outputFile, actualArgs := parseRedirection(args)
+	return status
+}
 
-	// Use command name (not full path) as argv[0] to match shell behavior
-	cmd := exec.Command(command, actualArgs...)
-	cmd.Path = fullPath
+// runAndOr runs a chain of pipelines with short-circuit evaluation:
+// the pipeline after && runs only if the previous status was zero, the
+// one after || only if it was non-zero
+func (e *Executor) runAndOr(andOr *AndOr, fds fdTable) int {
+	status := e.runPipeline(andOr.Pipelines[0], fds)
 
-	if outputFile != "" {
-		flags := os.O_WRONLY | os.O_CREATE
-		if strings.Contains(redirectType, ">>") {
-			flags |= os.O_APPEND
-		} else {
-			flags |= os.O_TRUNC
+	for i, op := range andOr.Ops {
+		if e.unwinding() {
+			break
 		}
-
-		file, err := os.OpenFile(outputFile, flags, 0644)
-		if err != nil {
-			return "", fmt.Errorf("redirect error: %v", err)
+		if (op == TokenAndIf && status != 0) || (op == TokenOrIf && status == 0) {
+			continue
 		}
-		defer file.Close()
+		status = e.runPipeline(andOr.Pipelines[i+1], fds)
+	}
 
-		switch redirectType {
-		case ">", "1>", ">>", "1>>":
-			cmd.Stdout = file
-			cmd.Stderr = os.Stderr
-		case "2>", "2>>":
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = file
-		}
+	return status
+}
 
-		// Silently run - errors are not returned for redirected commands
-		_ = cmd.Run()
-		return "", nil
+// runPipeline runs a single command or a pipeline of commands. The
+// status of every stage is recorded as PIPESTATUS. The pipeline's own
+// status is that of the last stage, or with pipefail that of the
+// rightmost stage that failed.
+func (e *Executor) runPipeline(pipeline *Pipeline, fds fdTable) int {
+	var statuses []int
+	if len(pipeline.Commands) > 1 {
+		statuses = e.executePipe(pipeline.Commands, fds)
+	} else {
+		statuses = []int{e.runCommand(pipeline.Commands[0], fds)}
 	}
 
-	var stderr bytes.Buffer
-	cmd.Stderr = &stderr
-
-	out, err := cmd.Output()
-	if err != nil {
-		if stderr.Len() > 0 {
-			return "", fmt.Errorf("%s", stderr.String())
+	status := statuses[len(statuses)-1]
+	if e.state.Options["pipefail"] {
+		for _, st := range statuses {
+			if st != 0 {
+				status = st
+			}
 		}
-		return "", err
 	}
 
-	return strings.TrimSuffix(string(out), "\n"), nil
+	e.state.PipeStatus = statuses
+	e.state.LastStatus = status
+	return status
 }
 
-// parseRedirection extracts redirection operators and file from arguments
-func parseRedirection(args []string) (redirectType, outputFile string, actualArgs []string) {
-	if len(args) < 2 {
-		return "", "", args
+// runCommand runs a single stage of a pipeline
+func (e *Executor) runCommand(node CommandNode, fds fdTable) int {
+	defer e.useFds(fds)()
+
+	switch cmd := node.(type) {
+	case *ArithCommand:
+		return e.runArith(cmd, fds)
+	case *IfCommand:
+		return e.withRedirects(cmd.Redirects, fds, func(fds fdTable) int { return e.runIf(cmd, fds) })
+	case *LoopCommand:
+		return e.withRedirects(cmd.Redirects, fds, func(fds fdTable) int { return e.runLoop(cmd, fds) })
+	case *ForCommand:
+		return e.withRedirects(cmd.Redirects, fds, func(fds fdTable) int { return e.runFor(cmd, fds) })
+	case *ArithForCommand:
+		return e.withRedirects(cmd.Redirects, fds, func(fds fdTable) int { return e.runArithFor(cmd, fds) })
+	case *CaseCommand:
+		return e.withRedirects(cmd.Redirects, fds, func(fds fdTable) int { return e.runCase(cmd, fds) })
+	case *GroupCommand:
+		return e.withRedirects(cmd.Redirects, fds, func(fds fdTable) int { return e.runList(cmd.Body, fds) })
+	default:
+		return e.runSimple(cmd.(*SimpleCommand), fds)
 	}
+}
 
-	redirectType = args[len(args)-2]
-	if strings.Contains(redirectType, ">") {
-		outputFile = args[len(args)-1]
-		actualArgs = args[:len(args)-2]
-		return
+// useFds makes fds the descriptors that command substitutions inherit
+// until the returned function restores the previous ones
+func (e *Executor) useFds(fds fdTable) func() {
+	prev := e.fds
+	e.fds = fds
+	return func() { e.fds = prev }
+}
+
+// runArith runs an arithmetic command: status 0 when the expression is
+// non-zero, 1 when it is zero or cannot be evaluated
+func (e *Executor) runArith(cmd *ArithCommand, fds fdTable) int {
+	cmdFds, opened, err := e.applyRedirects(fds, cmd.Redirects)
+	if err != nil {
+		return fds.fail(err, 1)
 	}
+	defer closeFiles(opened)
 
-	return "", "", args
+	v, err := e.evalArith(cmd.Expr)
+	if err != nil {
+		return cmdFds.fail(err, 1)
+	}
+	if v == 0 {
+		return 1
+	}
+	return 0
 }
 
-// executePipe handles piped commands
-func (e *Executor) executePipe(input string) error {
-	var commands [][]string
-	pipeCommands := strings.Split(input, "|")
-
-	for _, pc := range pipeCommands {
-		cmdParts := ParseArgs(strings.TrimSpace(pc))
-		commands = append(commands, cmdParts)
+// runSimple runs a simple command (builtin or external)
+func (e *Executor) runSimple(cmd *SimpleCommand, fds fdTable) int {
+	args, err := e.expandArgs(cmd.Args)
+	if err != nil {
+		return fds.fail(err, 1)
 	}
 
-	if len(commands) < 2 {
-		return nil
+	// without a command, assignments set shell variables and
+	// redirections just open the files
+	if len(args) == 0 {
+		return e.runAssigns(cmd, fds)
 	}
 
-	var cmds []*exec.Cmd
-	var pipes []*os.File
+	assigns, err := e.expandAssigns(cmd.Assigns)
+	if err != nil {
+		return fds.fail(err, 1)
+	}
 
-	// Create pipes
-	for i := 0; i < len(commands)-1; i++ {
-		r, w, err := os.Pipe()
+	cmdFds, opened, err := e.applyRedirects(fds, cmd.Redirects)
+	if err != nil {
+		return fds.fail(err, 1)
+	}
+	defer closeFiles(opened)
+
+	// Builtins see the redirected descriptors and report errors on
+	// the redirected stderr
+	if e.builtins.IsBuiltin(args[0]) {
+		// prefix assignments, as in IFS=: read a b, last while the
+		// builtin runs
+		restore, err := e.assignTemporarily(assigns)
 		if err != nil {
-			return err
+			return cmdFds.fail(err, 1)
+		}
+		defer restore()
+
+		// a failed write is an error even if the builtin ignores it,
+		// except a closed pipe, whose reader just stopped reading
+		stdout := &errWriter{w: cmdFds.writer(1)}
+		err = e.builtins.Execute(args[0], args[1:], cmdFds.reader(0), stdout)
+		if err == nil && stdout.err != nil && !errors.Is(stdout.err, syscall.EPIPE) {
+			err = fmt.Errorf("%s: write error: %s", args[0], osErrorText(stdout.err))
 		}
-		pipes = append(pipes, r, w)
+		if err != nil {
+			var status statusError
+			if errors.As(err, &status) {
+				return int(status)
+			}
+			var exit exitError
+			if errors.As(err, &exit) {
+				e.state.Exited, e.state.ExitStatus = true, int(exit)
+				return int(exit)
+			}
+			return cmdFds.fail(err, 1)
+		}
+		return 0
 	}
 
-	// Set up each command
-	for i, cmdParts := range commands {
-		if len(cmdParts) == 0 {
-			continue
-		}
+	// Execute external command
+	return e.executeExternal(args[0], args[1:], assigns, cmdFds)
+}
+
+// runAssigns runs a command that has no command name. Its assignments
+// are expanded and set from left to right, so each one sees the
+// variables set before it.
+func (e *Executor) runAssigns(cmd *SimpleCommand, fds fdTable) int {
+	cmdFds, opened, err := e.applyRedirects(fds, cmd.Redirects)
+	if err != nil {
+		return fds.fail(err, 1)
+	}
+	defer closeFiles(opened)
 
-		cmdName := cmdParts[0]
-		cmdArgs := cmdParts[1:]
+	for _, w := range cmd.Assigns {
+		name, _ := assignmentName(w.Text)
+		value, err := e.expandAssignValue(w.Text[len(name)+1:])
+		if err != nil {
+			return fds.fail(err, 1)
+		}
+		if err := e.state.Vars.Set(name, value); err != nil {
+			return cmdFds.fail(err, 1)
+		}
+	}
+	return e.assignStatus(cmd)
+}
 
-		if e.builtins.IsBuiltin(cmdName) {
-			// Handle builtin command in pipe
-			var stdin, stdout *os.File
+// assignTemporarily sets the variables of NAME=value assignments and
+// returns a function that gives them back their previous values
+func (e *Executor) assignTemporarily(assigns []string) (func(), error) {
+	vars := e.state.Vars
+	var undo []func()
+	restore := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
 
-			if i == 0 {
-				stdin = os.Stdin
+	for _, a := range assigns {
+		name, value, _ := strings.Cut(a, "=")
+		old, ok := vars.Lookup(name)
+		if err := vars.Set(name, value); err != nil {
+			restore()
+			return nil, err
+		}
+		undo = append(undo, func() {
+			if ok && old.HasValue {
+				vars.Set(name, old.Value)
 			} else {
-				stdin = pipes[(i-1)*2]
+				vars.Unset(name)
 			}
+		})
+	}
+	return restore, nil
+}
 
-			if i == len(commands)-1 {
-				stdout = os.Stdout
-			} else {
-				stdout = pipes[i*2+1]
-			}
+// assignStatus returns the status of a command without a command name:
+// the status of its last command substitution, or 0 if it had none
+func (e *Executor) assignStatus(cmd *SimpleCommand) int {
+	for _, w := range cmd.Assigns {
+		if hasCommandSubst(w.Text) {
+			return e.state.LastStatus
+		}
+	}
+	for _, r := range cmd.Redirects {
+		if hasCommandSubst(r.Target.Text) {
+			return e.state.LastStatus
+		}
+	}
+	return 0
+}
 
-			go func(name string, args []string, in, out *os.File, isLast bool) {
-				defer func() {
-					if !isLast {
-						out.Close()
-					}
-				}()
-				e.builtins.Execute(name, args, in, out)
-			}(cmdName, cmdArgs, stdin, stdout, i == len(commands)-1)
-		} else {
-			// Handle external command
-			fullPath := e.pathFinder.FindExecutable(cmdName)
-			if fullPath == "" {
-				continue
-			}
+// declarationBuiltins take NAME=value operands, which are expanded like
+// assignments instead of being split into fields
+var declarationBuiltins = map[string]bool{"export": true, "readonly": true, "declare": true}
 
-			cmd := exec.Command(fullPath, cmdArgs...)
+// expandArgs expands the words of a command into its arguments
+func (e *Executor) expandArgs(words []Token) ([]string, error) {
+	if len(words) == 0 || !declarationBuiltins[words[0].Text] {
+		return e.expandWords(words)
+	}
 
-			if i == 0 {
-				cmd.Stdin = os.Stdin
-			} else {
-				cmd.Stdin = pipes[(i-1)*2]
+	var args []string
+	for _, w := range words {
+		if !isAssignment(w) {
+			fields, err := e.expandWords([]Token{w})
+			if err != nil {
+				return nil, err
 			}
+			args = append(args, fields...)
+			continue
+		}
 
-			if i == len(commands)-1 {
-				cmd.Stdout = os.Stdout
-			} else {
-				cmd.Stdout = pipes[i*2+1]
-			}
+		arg, err := e.expandAssigns([]Token{w})
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg...)
+	}
+	return args, nil
+}
 
-			cmd.Stderr = os.Stderr
-			cmds = append(cmds, cmd)
+// expandAssigns expands the values of NAME=value words into the
+// NAME=value form of an environment entry
+func (e *Executor) expandAssigns(words []Token) ([]string, error) {
+	assigns := make([]string, 0, len(words))
+	for _, w := range words {
+		name, _ := assignmentName(w.Text)
+		value, err := e.expandAssignValue(w.Text[len(name)+1:])
+		if err != nil {
+			return nil, err
 		}
+		assigns = append(assigns, name+"="+value)
 	}
+	return assigns, nil
+}
 
-	// Start all external commands
-	for _, cmd := range cmds {
-		if err := cmd.Start(); err != nil {
-			return err
+// resolveCommand locates the program to run for command. On failure it
+// also returns the status POSIX shells use: 127 when the command does
+// not exist and 126 when it exists but cannot be executed. A PATH
+// among the env assignments of the command replaces the shell's own.
+func (e *Executor) resolveCommand(command string, env []string) (string, int, error) {
+	if !strings.Contains(command, "/") {
+		pf := e.pathFinder
+		for _, assign := range env {
+			if path, ok := strings.CutPrefix(assign, "PATH="); ok {
+				pf = &PathFinder{}
+				pf.SetPath(path)
+			}
+		}
+		if fullPath := pf.FindExecutable(command); fullPath != "" {
+			return fullPath, 0, nil
 		}
+		return "", 127, fmt.Errorf("%s: command not found", command)
+	}
+
+	path := e.state.Path(command)
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		return "", 127, fmt.Errorf("%s: No such file or directory", command)
+	case info.IsDir():
+		return "", 126, fmt.Errorf("%s: Is a directory", command)
+	case info.Mode()&0111 == 0:
+		return "", 126, fmt.Errorf("%s: Permission denied", command)
 	}
+	return path, 0, nil
+}
 
-	// Close all pipe write ends in parent
-	for i := 1; i < len(pipes); i += 2 {
-		pipes[i].Close()
+// exitStatus converts the result of running a process into a shell
+// exit status. Processes killed by a signal report 128 plus the signal
+// number.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
 	}
 
-	// Wait for all external commands
-	for _, cmd := range cmds {
-		cmd.Wait()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		// the process could not be started at all
+		return 126
 	}
+	if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return exitErr.ExitCode()
+}
 
-	// Close all pipe read ends
-	for i := 0; i < len(pipes); i += 2 {
-		pipes[i].Close()
+// executeExternal runs an external program with the given descriptors.
+// env holds NAME=value assignments that only apply to this program.
+func (e *Executor) executeExternal(command string, args []string, env []string, fds fdTable) int {
+	fullPath, status, err := e.resolveCommand(command, env)
+	if err != nil {
+		return fds.fail(err, status)
 	}
 
-	return nil
+	// Use command name (not full path) as argv[0] to match shell behavior
+	cmd := &exec.Cmd{Path: fullPath, Args: append([]string{command}, args...)}
+	cmd.Stdin = fds.reader(0)
+	// a closed stdout or stderr is passed as nil, which connects it to
+	// the null device
+	cmd.Stdout = fds[1].w
+	cmd.Stderr = fds[2].w
+	cmd.ExtraFiles = fds.extraFiles()
+	cmd.Dir = e.state.Dir
+	// later entries win, so prefix assignments override exported
+	// variables of the same name
+	cmd.Env = append(e.state.Vars.Environ(), env...)
+
+	// The program reports its own errors on its stderr, so only a
+	// failure to start it is reported here
+	err = cmd.Run()
+
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return fds.fail(fmt.Errorf("%s: %v", command, err), exitStatus(err))
+	}
+
+	// a program stopped by Ctrl+C stops the commands around it too
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() && ws.Signal() == syscall.SIGINT {
+		e.state.Interrupted = true
+	}
+	return exitStatus(err)
+}
+
+// executePipe runs the stages of a pipeline concurrently, each one
+// connected to its neighbours through OS pipes, and returns the status
+// of every stage once all of them have finished. Every stage is a
+// subshell, so stages cannot change the shell or each other.
+func (e *Executor) executePipe(stages []CommandNode, fds fdTable) []int {
+	statuses := make([]int, len(stages))
+	var subs []*Executor
+	var wg sync.WaitGroup
+
+	fds = fds.synchronized()
+
+	var prevRead *os.File
+	for i, stage := range stages {
+		// Connect the stage to its pipes; its own redirections are
+		// applied on top of these by runCommand
+		stageFds := fds.clone()
+		var ends []*os.File
+
+		if prevRead != nil {
+			stageFds[0] = fdEntry{r: prevRead}
+			ends = append(ends, prevRead)
+			prevRead = nil
+		}
+
+		if i < len(stages)-1 {
+			r, w, err := os.Pipe()
+			if err != nil {
+				closeFiles(ends)
+				wg.Wait()
+				statuses[i] = fds.fail(err, 1)
+				return statuses[:i+1]
+			}
+			stageFds[1] = fdEntry{w: w}
+			ends = append(ends, w)
+			prevRead = r
+		}
+
+		// the subshell copies the state before any stage can change it
+		sub := e.subshell()
+		subs = append(subs, sub)
+
+		wg.Add(1)
+		go func(i int, stage CommandNode, stageFds fdTable, ends []*os.File) {
+			defer wg.Done()
+			// A stage that cannot run, such as an unknown command,
+			// reports on its stderr and finishes with 127 or 126 like
+			// any other stage
+			statuses[i] = sub.runSubshell(func() int { return sub.runCommand(stage, stageFds) })
+			// Closing our copies lets the neighbours see EOF or EPIPE
+			// once the stage is done
+			closeFiles(ends)
+		}(i, stage, stageFds, ends)
+	}
+
+	wg.Wait()
+	for _, sub := range subs {
+		if sub.state.Interrupted {
+			e.state.Interrupted = true
+		}
+	}
+	return statuses
 }
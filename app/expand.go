@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// chunk is a piece of an expanded word together with how it was
+// produced, which decides what later expansion steps may do with it
+type chunk struct {
+	text string
+	// quoted text came from inside quotes or was escaped and is
+	// taken literally
+	quoted bool
+	// split text is the result of an unquoted expansion and is
+	// subject to field splitting
+	split bool
+}
+
+// chunks accumulates the pieces of a word during expansion
+type chunks []chunk
+
+// add appends text, merging it with the previous chunk when both were
+// produced the same way. Empty quoted text is kept because "" still
+// makes a word.
+func (c *chunks) add(text string, quoted, split bool) {
+	if text == "" && !quoted {
+		return
+	}
+	if n := len(*c); n > 0 && (*c)[n-1].quoted == quoted && (*c)[n-1].split == split {
+		(*c)[n-1].text += text
+		return
+	}
+	*c = append(*c, chunk{text: text, quoted: quoted, split: split})
+}
+
+// String joins the text of all chunks
+func (c chunks) String() string {
+	var b strings.Builder
+	for _, ch := range c {
+		b.WriteString(ch.text)
+	}
+	return b.String()
+}
+
+// expandWords expands the words of a command into the fields that
+// become its arguments: brace expansion comes first, followed by the
+// expansions of each resulting word, field splitting and filename
+// generation
+func (e *Executor) expandWords(words []Token) ([]string, error) {
+	var fields []string
+	for _, w := range words {
+		for _, text := range expandBraces(w.Text) {
+			expanded, err := e.expandText(text, tildeWord)
+			if err != nil {
+				return nil, err
+			}
+			for _, field := range splitFields(expanded, e.ifs()) {
+				matches, err := e.globField(field)
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, matches...)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// expandWord expands a word to a single string without field
+// splitting, as done for assignments and redirection targets
+func (e *Executor) expandWord(word Token) (string, error) {
+	return e.expandString(word.Text)
+}
+
+// expandString expands raw word text to a single string
+func (e *Executor) expandString(text string) (string, error) {
+	return e.expandStringTilde(text, tildeWord)
+}
+
+// expandAssignValue expands the value of a NAME=value assignment, in
+// which a tilde is also expanded after each colon as in PATH=~/bin:~/go
+func (e *Executor) expandAssignValue(text string) (string, error) {
+	return e.expandStringTilde(text, tildeAssign)
+}
+
+func (e *Executor) expandStringTilde(text string, tilde tildeMode) (string, error) {
+	expanded, err := e.expandText(text, tilde)
+	if err != nil {
+		return "", err
+	}
+	return expanded.String(), nil
+}
+
+// defaultIFS is the field separator used when IFS is unset
+const defaultIFS = " \t\n"
+
+// ifs returns the current field separators
+func (e *Executor) ifs() string {
+	if ifs, ok := e.state.Vars.Get("IFS"); ok {
+		return ifs
+	}
+	return defaultIFS
+}
+
+// splitFields splits the unquoted expansion results of a word into
+// fields at the characters of ifs. Runs of IFS whitespace separate
+// fields and are dropped at the ends; every other IFS character ends a
+// field, so two of them in a row delimit an empty field. Literal and
+// quoted text never splits, and a word that expands to nothing
+// produces no field at all.
+func splitFields(word chunks, ifs string) []chunks {
+	var fields []chunks
+	var curr chunks
+	// started is set once the current field has content, possibly
+	// an empty quoted string
+	started := false
+	// afterSpace is set when the last field was ended by whitespace,
+	// which a following non-whitespace separator then belongs to
+	afterSpace := false
+
+	for _, ch := range word {
+		if !ch.split || ifs == "" {
+			curr = append(curr, ch)
+			started = true
+			continue
+		}
+
+		start := 0
+		for i, c := range ch.text {
+			if !strings.ContainsRune(ifs, c) {
+				continue
+			}
+			if i > start {
+				curr.add(ch.text[start:i], false, true)
+				started = true
+			}
+			start = i + utf8.RuneLen(c)
+
+			if isIFSSpace(c) {
+				if started {
+					fields = append(fields, curr)
+					curr, started, afterSpace = nil, false, true
+				}
+				continue
+			}
+
+			if started || !afterSpace {
+				fields = append(fields, curr)
+			}
+			curr, started, afterSpace = nil, false, false
+		}
+		if start < len(ch.text) {
+			curr.add(ch.text[start:], false, true)
+			started = true
+		}
+	}
+
+	if started {
+		fields = append(fields, curr)
+	}
+	return fields
+}
+
+func isIFSSpace(c rune) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+// tildeMode selects where expandText performs tilde expansion
+type tildeMode int
+
+const (
+	tildeNone   tildeMode = iota
+	tildeWord             // at the start of the word
+	tildeAssign           // at the start and after every colon
+)
+
+// expandText performs tilde expansion, parameter expansion, command
+// substitution, arithmetic expansion and quote removal on the raw text
+// of a word
+func (e *Executor) expandText(text string, tilde tildeMode) (chunks, error) {
+	var out chunks
+
+	for i := 0; i < len(text); {
+		c := text[i]
+
+		if c == '~' && (tilde == tildeWord && i == 0 || tilde == tildeAssign && (i == 0 || text[i-1] == ':')) {
+			if home, end, ok := e.expandTilde(text, i, tilde == tildeAssign); ok {
+				out.add(home, true, false)
+				i = end
+				continue
+			}
+		}
+
+		switch c {
+		case '\\':
+			// a backslash-newline is a line continuation and disappears
+			if i+1 < len(text) && text[i+1] != '\n' {
+				out.add(text[i+1:i+2], true, false)
+			}
+			i += 2
+		case '\'':
+			end := skipSingleQuoted(text, i)
+			out.add(strings.TrimSuffix(text[i+1:end], "'"), true, false)
+			i = end
+		case '"':
+			next, err := e.expandDoubleQuoted(text, i+1, &out)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+		case '$':
+			next, err := e.expandDollar(text, i, false, &out)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+		case '`':
+			next, err := e.expandBackquoted(text, i, false, &out)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+		default:
+			out.add(text[i:i+1], false, false)
+			i++
+		}
+	}
+
+	return out, nil
+}
+
+// expandHeredoc expands the body of a here-document. It behaves like
+// the inside of double quotes, except that double quotes are ordinary
+// characters.
+func (e *Executor) expandHeredoc(body string) (string, error) {
+	var out chunks
+
+	for i := 0; i < len(body); {
+		c := body[i]
+		switch {
+		case c == '\\' && i+1 < len(body):
+			switch next := body[i+1]; next {
+			case '$', '`', '\\':
+				out.add(body[i+1:i+2], true, false)
+			case '\n':
+			default:
+				out.add(body[i:i+2], true, false)
+			}
+			i += 2
+		case c == '$':
+			next, err := e.expandDollar(body, i, true, &out)
+			if err != nil {
+				return "", err
+			}
+			i = next
+		case c == '`':
+			next, err := e.expandBackquoted(body, i, true, &out)
+			if err != nil {
+				return "", err
+			}
+			i = next
+		default:
+			out.add(body[i:i+1], true, false)
+			i++
+		}
+	}
+	return out.String(), nil
+}
+
+// expandDoubleQuoted expands the inside of a double-quoted string that
+// starts at i and returns the position after the closing quote.
+// Everything it produces is quoted.
+func (e *Executor) expandDoubleQuoted(text string, i int, out *chunks) (int, error) {
+	// an empty pair of quotes still makes a word
+	out.add("", true, false)
+
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == '"':
+			return i + 1, nil
+		case c == '\\' && i+1 < len(text):
+			switch next := text[i+1]; next {
+			case '$', '`', '"', '\\':
+				out.add(text[i+1:i+2], true, false)
+			case '\n':
+			default:
+				out.add(text[i:i+2], true, false)
+			}
+			i += 2
+		case c == '$':
+			next, err := e.expandDollar(text, i, true, out)
+			if err != nil {
+				return 0, err
+			}
+			i = next
+		case c == '`':
+			next, err := e.expandBackquoted(text, i, true, out)
+			if err != nil {
+				return 0, err
+			}
+			i = next
+		default:
+			out.add(text[i:i+1], true, false)
+			i++
+		}
+	}
+	return i, nil
+}
+
+// expandDollar expands the parameter reference that starts with the $
+// at i and returns the position after it. A $ that does not start a
+// parameter is kept literally.
+func (e *Executor) expandDollar(text string, i int, quoted bool, out *chunks) (int, error) {
+	rest := text[i+1:]
+
+	var value string
+	var next int
+	switch {
+	case strings.HasPrefix(rest, "((") && strings.HasSuffix(text[:skipDollar(text, i, quoted)], "))"):
+		end := skipDollar(text, i, quoted)
+		v, err := e.arithSubst(text[i+3 : end-2])
+		if err != nil {
+			return 0, err
+		}
+		value, next = v, end
+	case strings.HasPrefix(rest, "("):
+		end := skipDollar(text, i, quoted)
+		if !strings.HasSuffix(text[:end], ")") {
+			return 0, fmt.Errorf("unexpected EOF while looking for matching `)'")
+		}
+		v, err := e.commandSubst(text[i+2 : end-1])
+		if err != nil {
+			return 0, err
+		}
+		value, next = v, end
+	case strings.HasPrefix(rest, "{"):
+		end := skipDollar(text, i, quoted)
+		if !strings.HasSuffix(text[:end], "}") {
+			return 0, fmt.Errorf("%s: bad substitution", text[i:end])
+		}
+		v, err := e.expandBraced(text[i+2:end-1], text[i:end])
+		if err != nil {
+			return 0, err
+		}
+		if quoted {
+			out.add(v.String(), true, false)
+			return end, nil
+		}
+		// unquoted parts of an operator word are split like the value
+		for _, c := range v {
+			out.add(c.text, c.quoted, !c.quoted)
+		}
+		return end, nil
+	case rest != "" && strings.ContainsRune(specialParams, rune(rest[0])):
+		value, _ = e.lookupParam(rest[:1])
+		next = i + 2
+	case isNameChar(rest, 0):
+		n := 1
+		for isNameChar(rest, n) {
+			n++
+		}
+		value, _ = e.lookupParam(rest[:n])
+		next = i + 1 + n
+	default:
+		out.add("$", quoted, false)
+		return i + 1, nil
+	}
+
+	out.add(value, quoted, !quoted)
+	return next, nil
+}
+
+// expandBackquoted expands the `...` command substitution that starts
+// at i and returns the position after it
+func (e *Executor) expandBackquoted(text string, i int, quoted bool, out *chunks) (int, error) {
+	end := skipBackquoted(text, i)
+	if end == i+1 || text[end-1] != '`' {
+		return 0, fmt.Errorf("unexpected EOF while looking for matching ``'")
+	}
+
+	// inside backquotes a backslash only escapes $, ` and \
+	var command strings.Builder
+	inner := text[i+1 : end-1]
+	for j := 0; j < len(inner); j++ {
+		if inner[j] == '\\' && j+1 < len(inner) && strings.IndexByte("$`\\", inner[j+1]) >= 0 {
+			j++
+		}
+		command.WriteByte(inner[j])
+	}
+
+	value, err := e.commandSubst(command.String())
+	if err != nil {
+		return 0, err
+	}
+	out.add(value, quoted, !quoted)
+	return end, nil
+}
+
+// commandSubst runs a command and returns its output without trailing
+// newlines. Its exit status becomes $?.
+func (e *Executor) commandSubst(command string) (string, error) {
+	list, err := Parse(command)
+	if err != nil {
+		return "", err
+	}
+
+	// the command runs in a subshell, so it cannot change the shell, and
+	// sees the descriptors of the command it is part of except stdout
+	var stdout bytes.Buffer
+	fds := newFdTable(e.Stdin, e.Stdout, e.Stderr)
+	if e.fds != nil {
+		fds = e.fds.clone()
+	}
+	fds[1] = fdEntry{w: &stdout}
+
+	sub := e.subshell()
+	e.state.LastStatus = sub.runSubshell(func() int {
+		return sub.runList(list, fds)
+	})
+	if sub.state.Interrupted {
+		e.state.Interrupted = true
+	}
+	return strings.TrimRight(stdout.String(), "\n"), nil
+}
+
+// expandTilde expands the tilde prefix that starts at text[i]: ~ is the
+// home directory, ~user the home directory of user, ~+ the current and
+// ~- the previous working directory. It returns the index after the
+// prefix, or false if the prefix is quoted or cannot be expanded.
+func (e *Executor) expandTilde(text string, i int, assign bool) (string, int, bool) {
+	end := i + 1
+	for end < len(text) && text[end] != '/' && !(assign && text[end] == ':') {
+		end++
+	}
+
+	name := text[i+1 : end]
+	if strings.ContainsAny(name, "'\"\\$`") {
+		return "", 0, false
+	}
+
+	var dir string
+	var ok bool
+	switch name {
+	case "":
+		if dir, ok = e.state.Vars.Get("HOME"); !ok {
+			if u, err := user.Current(); err == nil {
+				dir, ok = u.HomeDir, true
+			}
+		}
+	case "+":
+		cwd, err := e.state.WorkDir()
+		dir, ok = cwd, err == nil
+	case "-":
+		dir, ok = e.state.Vars.Get("OLDPWD")
+	default:
+		if u, err := user.Lookup(name); err == nil {
+			dir, ok = u.HomeDir, true
+		}
+	}
+	return dir, end, ok
+}
+
+// arithSubst expands and evaluates the expression of $((...))
+func (e *Executor) arithSubst(expr string) (string, error) {
+	v, err := e.evalArith(expr)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(v, 10), nil
+}
+
+// evalArith expands the parameters and command substitutions of an
+// arithmetic expression and evaluates it
+func (e *Executor) evalArith(expr string) (int64, error) {
+	// ~ is an operator here, not a home directory
+	expanded, err := e.expandStringTilde(expr, tildeNone)
+	if err != nil {
+		return 0, err
+	}
+	return evalArith(expanded, e.state.Vars)
+}
+
+// hasCommandSubst reports whether the raw text of a word contains a
+// command substitution outside single quotes
+func hasCommandSubst(text string) bool {
+	inDouble := false
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			inDouble = !inDouble
+		case '\'':
+			if !inDouble {
+				i = skipSingleQuoted(text, i) - 1
+			}
+		case '`':
+			return true
+		case '$':
+			if strings.HasPrefix(text[i:], "$(") {
+				return true
+			}
+		}
+	}
+	return false
+}
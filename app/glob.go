@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// globOptions are the shell options that change filename generation
+type globOptions struct {
+	// dotglob lets patterns match names starting with a dot
+	dotglob bool
+	// globstar makes ** match any number of directories
+	globstar bool
+	// dir is the directory relative patterns are matched in, or empty
+	// for the working directory of the process
+	dir string
+}
+
+// resolve returns the path by which to access a path relative to
+// opts.dir, where the empty path is the directory itself
+func (opts globOptions) resolve(path string) string {
+	if path == "" {
+		path = "."
+	}
+	if opts.dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(opts.dir, path)
+}
+
+// globField performs filename generation on a field. A field without
+// unquoted pattern characters, or one that matches nothing, is kept as
+// it is unless nullglob or failglob is set.
+func (e *Executor) globField(field chunks) ([]string, error) {
+	pattern, ok := globPattern(field)
+	if !ok {
+		return []string{field.String()}, nil
+	}
+
+	matches := expandGlob(pattern, globOptions{
+		dotglob:  e.state.Options["dotglob"],
+		globstar: e.state.Options["globstar"],
+		dir:      e.state.Dir,
+	})
+	if len(matches) > 0 {
+		return matches, nil
+	}
+
+	switch {
+	case e.state.Options["nullglob"]:
+		return nil, nil
+	case e.state.Options["failglob"]:
+		return nil, fmt.Errorf("no match: %s", field.String())
+	}
+	return []string{field.String()}, nil
+}
+
+// globPattern turns a field into a pattern in which quoted characters
+// only match themselves. It reports false if the field has no unquoted
+// pattern characters and so is not subject to filename generation.
+func globPattern(field chunks) (string, bool) {
+	var b strings.Builder
+	isGlob := false
+	for _, ch := range field {
+		if ch.quoted {
+			b.WriteString(escapePattern(ch.text))
+			continue
+		}
+		if strings.ContainsAny(ch.text, "*?[") {
+			isGlob = true
+		}
+		b.WriteString(ch.text)
+	}
+	return b.String(), isGlob
+}
+
+// expandGlob returns the sorted paths that match pattern. Each
+// component of the pattern is matched against the entries of the
+// directories matched so far.
+func expandGlob(pattern string, opts globOptions) []string {
+	components := strings.Split(pattern, "/")
+
+	// the empty path stands for the current directory, whose name is
+	// not part of the results
+	paths := []string{""}
+	if strings.HasPrefix(pattern, "/") {
+		paths = []string{"/"}
+		components = components[1:]
+	}
+
+	for i, component := range components {
+		last := i == len(components)-1
+
+		var next []string
+		for _, dir := range paths {
+			next = append(next, globComponent(dir, component, last, opts)...)
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		paths = next
+	}
+
+	sort.Strings(paths)
+	return paths
+}
+
+// globComponent returns the paths in dir that match one component of a
+// pattern. last reports whether it is the final component.
+func globComponent(dir, component string, last bool, opts globOptions) []string {
+	switch {
+	case component == "":
+		// a trailing or doubled slash only matches directories
+		if isDir(opts.resolve(dir)) {
+			return []string{dir + "/"}
+		}
+		return nil
+	case !hasGlobChars(component):
+		path := joinPath(dir, unescapePattern(component))
+		if _, err := os.Lstat(opts.resolve(path)); err != nil {
+			return nil
+		}
+		return []string{path}
+	case component == "**" && opts.globstar:
+		return globStar(dir, last, opts)
+	}
+
+	var matches []string
+	for _, name := range readDirNames(opts.resolve(dir)) {
+		if strings.HasPrefix(name, ".") && !opts.dotglob && !strings.HasPrefix(component, ".") {
+			continue
+		}
+		if matchPattern(component, name) {
+			matches = append(matches, joinPath(dir, name))
+		}
+	}
+	return matches
+}
+
+// globStar implements ** with globstar set: it matches dir itself and
+// all directories below it or, as the final component, every file and
+// directory below dir
+func globStar(dir string, last bool, opts globOptions) []string {
+	var matches []string
+	if !last {
+		matches = append(matches, dir)
+	}
+
+	for _, name := range readDirNames(opts.resolve(dir)) {
+		if strings.HasPrefix(name, ".") && !opts.dotglob {
+			continue
+		}
+		path := joinPath(dir, name)
+
+		info, err := os.Lstat(opts.resolve(path))
+		if err != nil {
+			continue
+		}
+		// symbolic links are not followed, so cycles cannot occur
+		if info.IsDir() {
+			if last {
+				matches = append(matches, path)
+			}
+			matches = append(matches, globStar(path, last, opts)...)
+		} else if last {
+			matches = append(matches, path)
+		}
+	}
+	return matches
+}
+
+// readDirNames returns the names in a directory
+func readDirNames(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func joinPath(dir, name string) string {
+	if dir == "" || strings.HasSuffix(dir, "/") {
+		return dir + name
+	}
+	return dir + "/" + name
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// hasGlobChars reports whether a pattern contains unescaped pattern
+// characters
+func hasGlobChars(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapePattern removes the backslashes that quote characters of a
+// pattern
+func unescapePattern(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
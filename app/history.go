@@ -3,7 +3,10 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 )
 
 type History struct {
@@ -23,7 +26,7 @@ func (history *History) GetLine(i int) (string, error) {
 	return history.Items[i], nil
 }
 
-func (history *History) Get() {
+func (history *History) Get(w io.Writer) {
 	total := len(history.Items)
 	start := total - history.MaxLen
 
@@ -36,7 +39,7 @@ func (history *History) Get() {
 		if err != nil {
 			continue
 		}
-		fmt.Printf("%d  %s\n", i, line)
+		fmt.Fprintf(w, "%d  %s\n", i, line)
 	}
 }
 
@@ -49,7 +52,15 @@ func (history *History) ReadFromFile() error {
 	scanner := bufio.NewScanner(file)
 
 	for scanner.Scan() {
-		history.Items = append(history.Items, scanner.Text())
+		item := scanner.Text()
+		if n, ok := historyHeader(item); ok {
+			lines := make([]string, 0, n)
+			for len(lines) < n && scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			item = strings.Join(lines, "\n")
+		}
+		history.Items = append(history.Items, item)
 	}
 
 	return scanner.Err()
@@ -63,7 +74,7 @@ func (History *History) WriteToFile() error {
 	defer file.Close()
 
 	for _, item := range history.Items {
-		if _, err := file.WriteString(item + "\n"); err != nil {
+		if err := writeHistoryItem(file, item); err != nil {
 			return err
 		}
 	}
@@ -78,10 +89,36 @@ func (history *History) AppendToFile() error {
 	defer file.Close()
 
 	for _, item := range history.Items {
-		if _, err := file.WriteString(item + "\n"); err != nil {
+		if err := writeHistoryItem(file, item); err != nil {
 			return err
 		}
 	}
 	history.Items = []string{}
 	return nil
 }
+
+// writeHistoryItem writes an entry to a history file. Entries are
+// written as they are, one per line; one that spans several lines, or
+// that looks like a header itself, is preceded by a #+N line that gives
+// the number of lines it has.
+func writeHistoryItem(w io.Writer, item string) error {
+	lines := strings.Count(item, "\n") + 1
+	if _, ok := historyHeader(item); ok || lines > 1 {
+		if _, err := fmt.Fprintf(w, "#+%d\n", lines); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, item+"\n")
+	return err
+}
+
+// historyHeader returns the number of lines of the entry that follows
+// a #+N line
+func historyHeader(line string) (int, bool) {
+	digits, ok := strings.CutPrefix(line, "#+")
+	if !ok || digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(digits)
+	return n, err == nil && n > 0
+}
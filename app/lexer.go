@@ -0,0 +1,538 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TokenKind identifies the lexical class of a Token
+type TokenKind int
+
+const (
+	TokenWord      TokenKind = iota
+	TokenPipe                // |
+	TokenGreat               // >
+	TokenDGreat              // >>
+	TokenLess                // <
+	TokenGreatAnd            // >&
+	TokenLessAnd             // <&
+	TokenAndGreat            // &>
+	TokenAndDGreat           // &>>
+	TokenLessGreat           // <>
+	TokenClobber             // >|
+	TokenDLess               // <<
+	TokenDLessDash           // <<-
+	TokenTLess               // <<<
+	TokenAndIf               // &&
+	TokenOrIf                // ||
+	TokenSemi                // ;
+	TokenDSemi               // ;;
+	TokenLParen              // (
+	TokenRParen              // )
+	TokenAmp                 // &
+	TokenNewline             // \n
+	TokenArith               // ((expr))
+	TokenEOF
+)
+
+var tokenNames = map[TokenKind]string{
+	TokenWord:      "word",
+	TokenPipe:      "|",
+	TokenGreat:     ">",
+	TokenDGreat:    ">>",
+	TokenLess:      "<",
+	TokenGreatAnd:  ">&",
+	TokenLessAnd:   "<&",
+	TokenAndGreat:  "&>",
+	TokenAndDGreat: "&>>",
+	TokenLessGreat: "<>",
+	TokenClobber:   ">|",
+	TokenDLess:     "<<",
+	TokenDLessDash: "<<-",
+	TokenTLess:     "<<<",
+	TokenAndIf:     "&&",
+	TokenOrIf:      "||",
+	TokenSemi:      ";",
+	TokenDSemi:     ";;",
+	TokenLParen:    "(",
+	TokenRParen:    ")",
+	TokenAmp:       "&",
+	TokenNewline:   "newline",
+	TokenArith:     "((",
+	TokenEOF:       "EOF",
+}
+
+func (k TokenKind) String() string {
+	return tokenNames[k]
+}
+
+// Token is a single lexical unit of a command line
+type Token struct {
+	Kind TokenKind
+	// Text is the raw source text of the token. For words it still
+	// contains the quotes and backslashes as typed.
+	Text string
+	// Value is the word after quote removal, or the expression of an
+	// arithmetic command
+	Value string
+	// Quoted reports whether any part of a word was quoted or escaped
+	Quoted bool
+	// Fd is the explicit descriptor of a redirection such as "2>",
+	// or -1 when none was given
+	Fd int
+	// Pos is the byte offset of the token in the input
+	Pos int
+	// Body is the content of a here-document. It is stored on the
+	// word that follows << or <<-, the delimiter.
+	Body string
+}
+
+// IsRedirect reports whether the token is a redirection operator
+func (t Token) IsRedirect() bool {
+	switch t.Kind {
+	case TokenGreat, TokenDGreat, TokenLess, TokenGreatAnd, TokenLessAnd,
+		TokenAndGreat, TokenAndDGreat, TokenLessGreat, TokenClobber,
+		TokenDLess, TokenDLessDash, TokenTLess:
+		return true
+	}
+	return false
+}
+
+// Lexer splits a command line into tokens
+type Lexer struct {
+	input  string
+	pos    int
+	tokens []Token
+	// heredocs holds the indexes of the here-document operators whose
+	// bodies start after the next newline
+	heredocs []int
+	// unterminated is set when the input ended inside a quoted string
+	// or expansion, right after a backslash or before the delimiter of
+	// a here-document
+	unterminated bool
+	// err reports the first quoted string or expansion left unclosed
+	err *SyntaxError
+}
+
+// Lex tokenizes input into words and operators. The returned slice
+// always ends with a TokenEOF token.
+func Lex(input string) []Token {
+	l := &Lexer{input: input}
+	l.run()
+	return l.tokens
+}
+
+func (l *Lexer) run() {
+	for {
+		l.skipBlanks()
+		if l.pos >= len(l.input) {
+			if len(l.heredocs) > 0 {
+				l.unterminated = true
+			}
+			l.emit(Token{Kind: TokenEOF, Fd: -1, Pos: l.pos})
+			return
+		}
+
+		c := l.input[l.pos]
+		switch {
+		case c == '#':
+			l.skipComment()
+		case c == '\n':
+			l.emit(Token{Kind: TokenNewline, Text: "\n", Fd: -1, Pos: l.pos})
+			l.pos++
+			l.readHeredocs()
+		case strings.HasPrefix(l.input[l.pos:], "(("):
+			l.lexArith()
+		case isOperatorStart(c):
+			l.lexOperator(-1, l.pos)
+		default:
+			l.lexWord()
+		}
+	}
+}
+
+func (l *Lexer) emit(tok Token) {
+	l.tokens = append(l.tokens, tok)
+}
+
+// skipBlanks skips blanks and line continuations between tokens
+func (l *Lexer) skipBlanks() {
+	for l.pos < len(l.input) {
+		switch {
+		case l.input[l.pos] == ' ' || l.input[l.pos] == '\t':
+			l.pos++
+		case strings.HasPrefix(l.input[l.pos:], "\\\n"):
+			l.pos += 2
+		default:
+			return
+		}
+	}
+}
+
+func (l *Lexer) skipComment() {
+	for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+		l.pos++
+	}
+}
+
+func isOperatorStart(c byte) bool {
+	return c == '|' || c == '&' || c == ';' || c == '<' || c == '>' || c == '(' || c == ')'
+}
+
+// lexOperator reads the operator at the current position. fd is the
+// IO number that preceded a redirection and start is where it began.
+func (l *Lexer) lexOperator(fd int, start int) {
+	rest := l.input[l.pos:]
+
+	kind := TokenWord
+	width := 1
+	switch {
+	case strings.HasPrefix(rest, "<<<"):
+		kind, width = TokenTLess, 3
+	case strings.HasPrefix(rest, "<<-"):
+		kind, width = TokenDLessDash, 3
+	case strings.HasPrefix(rest, "<<"):
+		kind, width = TokenDLess, 2
+	case strings.HasPrefix(rest, "&>>"):
+		kind, width = TokenAndDGreat, 3
+	case strings.HasPrefix(rest, "&>"):
+		kind, width = TokenAndGreat, 2
+	case strings.HasPrefix(rest, "&&"):
+		kind, width = TokenAndIf, 2
+	case strings.HasPrefix(rest, "||"):
+		kind, width = TokenOrIf, 2
+	case strings.HasPrefix(rest, ">>"):
+		kind, width = TokenDGreat, 2
+	case strings.HasPrefix(rest, ">&"):
+		kind, width = TokenGreatAnd, 2
+	case strings.HasPrefix(rest, ">|"):
+		kind, width = TokenClobber, 2
+	case strings.HasPrefix(rest, "<&"):
+		kind, width = TokenLessAnd, 2
+	case strings.HasPrefix(rest, "<>"):
+		kind, width = TokenLessGreat, 2
+	case strings.HasPrefix(rest, ";;"):
+		kind, width = TokenDSemi, 2
+	case rest[0] == '>':
+		kind = TokenGreat
+	case rest[0] == '<':
+		kind = TokenLess
+	case rest[0] == '|':
+		kind = TokenPipe
+	case rest[0] == '&':
+		kind = TokenAmp
+	case rest[0] == ';':
+		kind = TokenSemi
+	case rest[0] == '(':
+		kind = TokenLParen
+	case rest[0] == ')':
+		kind = TokenRParen
+	}
+
+	l.pos += width
+	if kind == TokenDLess || kind == TokenDLessDash {
+		l.heredocs = append(l.heredocs, len(l.tokens))
+	}
+	l.emit(Token{Kind: kind, Text: l.input[start:l.pos], Fd: fd, Pos: start})
+}
+
+// readHeredocs reads the bodies of the pending here-documents, which
+// follow the line that introduced them in order. Each body ends with a
+// line holding just its delimiter; <<- strips leading tabs from every
+// line first.
+func (l *Lexer) readHeredocs() {
+	for _, op := range l.heredocs {
+		if op+1 >= len(l.tokens) || l.tokens[op+1].Kind != TokenWord {
+			continue
+		}
+		delim := l.tokens[op+1].Value
+		stripTabs := l.tokens[op].Kind == TokenDLessDash
+
+		var body strings.Builder
+		terminated := false
+		for l.pos < len(l.input) {
+			line := l.input[l.pos:]
+			end := strings.IndexByte(line, '\n')
+			if end >= 0 {
+				line = line[:end]
+				l.pos += end + 1
+			} else {
+				l.pos = len(l.input)
+			}
+
+			if stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == delim {
+				terminated = true
+				break
+			}
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+
+		l.tokens[op+1].Body = body.String()
+		if !terminated {
+			l.unterminated = true
+		}
+	}
+	l.heredocs = nil
+}
+
+// lexArith reads an arithmetic command ((expr)). Without the closing
+// )) the rest of the input is taken as the expression.
+func (l *Lexer) lexArith() {
+	start := l.pos
+	skip := func(text string, i int) int {
+		return skipUntil(text, i+1, ')', false)
+	}
+	l.pos = skip(l.input, start)
+	if !isClosed(skip, l.input, start) {
+		l.unclosed(start, ')')
+	}
+
+	expr := l.input[start+2 : l.pos]
+	expr = strings.TrimSuffix(expr, "))")
+	l.emit(Token{Kind: TokenArith, Text: l.input[start:l.pos], Value: expr, Fd: -1, Pos: start})
+}
+
+// lexWord reads a word, honouring quotes and backslash escapes
+func (l *Lexer) lexWord() {
+	start := l.pos
+
+	// A run of digits directly followed by < or > is an IO number
+	digits := l.pos
+	for digits < len(l.input) && l.input[digits] >= '0' && l.input[digits] <= '9' {
+		digits++
+	}
+	if digits > l.pos && digits < len(l.input) && (l.input[digits] == '<' || l.input[digits] == '>') {
+		fd, _ := strconv.Atoi(l.input[l.pos:digits])
+		l.pos = digits
+		l.lexOperator(fd, start)
+		return
+	}
+
+	var value strings.Builder
+	quoted := false
+
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+
+		if c == ' ' || c == '\t' || c == '\n' || isOperatorStart(c) {
+			break
+		}
+
+		switch c {
+		case '\\':
+			l.pos++
+			switch {
+			case l.pos == len(l.input):
+				l.unterminated = true
+			case l.input[l.pos] == '\n':
+				// line continuation
+				l.pos++
+			default:
+				quoted = true
+				value.WriteByte(l.input[l.pos])
+				l.pos++
+			}
+		case '\'':
+			quoted = true
+			quote := l.pos
+			l.pos++
+			for l.pos < len(l.input) && l.input[l.pos] != '\'' {
+				value.WriteByte(l.input[l.pos])
+				l.pos++
+			}
+			if l.pos == len(l.input) {
+				l.unclosed(quote, '\'')
+			}
+			l.pos++ // closing quote
+		case '"':
+			quoted = true
+			l.pos++
+			l.lexDoubleQuoted(&value)
+		case '$', '`':
+			l.lexExpansion(&value, false)
+		default:
+			value.WriteByte(c)
+			l.pos++
+		}
+	}
+
+	if l.pos > len(l.input) {
+		l.pos = len(l.input)
+	}
+
+	l.emit(Token{
+		Kind:   TokenWord,
+		Text:   l.input[start:l.pos],
+		Value:  value.String(),
+		Quoted: quoted,
+		Fd:     -1,
+		Pos:    start,
+	})
+}
+
+// lexDoubleQuoted reads up to and including the closing double quote.
+// Inside double quotes a backslash only escapes $, `, ", \ and newline.
+func (l *Lexer) lexDoubleQuoted(value *strings.Builder) {
+	quote := l.pos - 1
+	for l.pos < len(l.input) {
+		c := l.input[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return
+		case c == '\\' && l.pos+1 < len(l.input):
+			next := l.input[l.pos+1]
+			switch next {
+			case '$', '`', '"', '\\':
+				value.WriteByte(next)
+			case '\n':
+				// line continuation
+			default:
+				value.WriteByte('\\')
+				value.WriteByte(next)
+			}
+			l.pos += 2
+		case c == '$' || c == '`':
+			l.lexExpansion(value, true)
+		default:
+			value.WriteByte(c)
+			l.pos++
+		}
+	}
+	l.unclosed(quote, '"')
+}
+
+// lexExpansion copies the expansion or command substitution that
+// starts with the $ or ` at the current position into value
+func (l *Lexer) lexExpansion(value *strings.Builder, inDouble bool) {
+	skip := func(text string, i int) int {
+		if text[i] == '`' {
+			return skipBackquoted(text, i)
+		}
+		return skipDollar(text, i, inDouble)
+	}
+
+	end := skip(l.input, l.pos)
+	if end == len(l.input) && !isClosed(skip, l.input, l.pos) {
+		match := byte('`')
+		switch {
+		case strings.HasPrefix(l.input[l.pos:], "${"):
+			match = '}'
+		case strings.HasPrefix(l.input[l.pos:], "$("):
+			match = ')'
+		}
+		l.unclosed(l.pos, match)
+	}
+	value.WriteString(l.input[l.pos:end])
+	l.pos = end
+}
+
+// unclosed records that the input ended inside the quoted string or
+// expansion that starts at pos and is closed by match
+func (l *Lexer) unclosed(pos int, match byte) {
+	l.unterminated = true
+	if l.err == nil {
+		l.err = newSyntaxError(l.input, pos)
+		l.err.Msg = fmt.Sprintf("unexpected EOF while looking for matching `%c'", match)
+		l.err.Incomplete = true
+	}
+}
+
+// isClosed reports whether the quoted string or expansion that skip
+// scans from text[i] ends within text. An unclosed one runs on to the
+// end of the text, so it also takes in a character appended to it.
+func isClosed(skip func(text string, i int) int, text string, i int) bool {
+	return skip(text+"\x00", i) <= len(text)
+}
+
+// skipDollar returns the index just past the expansion introduced by
+// the $ at text[i]. Braced expansions and command substitutions may
+// contain blanks, operators, quotes and nested expansions. An
+// unterminated expansion extends to the end of text.
+func skipDollar(text string, i int, inDouble bool) int {
+	switch {
+	case strings.HasPrefix(text[i:], "${"):
+		return skipUntil(text, i+2, '}', inDouble)
+	case strings.HasPrefix(text[i:], "$("):
+		// the command inside starts a new quoting context
+		return skipUntil(text, i+2, ')', false)
+	}
+	return i + 1
+}
+
+// skipUntil returns the index just past the first unquoted occurrence
+// of end at or after i that is not inside a nested expansion or, when
+// end is ), inside nested parentheses
+func skipUntil(text string, i int, end byte, inDouble bool) int {
+	for i < len(text) {
+		c := text[i]
+		switch {
+		case c == end:
+			return i + 1
+		case c == '(' && end == ')':
+			i = skipUntil(text, i+1, ')', inDouble)
+		case c == '`':
+			i = skipBackquoted(text, i)
+		case c == '\\':
+			i += 2
+		case c == '\'' && !inDouble:
+			i = skipSingleQuoted(text, i)
+		case c == '"':
+			i = skipDoubleQuoted(text, i)
+		case c == '$':
+			i = skipDollar(text, i, inDouble)
+		default:
+			i++
+		}
+	}
+	return len(text)
+}
+
+// skipSingleQuoted returns the index just past the single-quoted
+// string that starts at text[i]
+func skipSingleQuoted(text string, i int) int {
+	end := strings.IndexByte(text[i+1:], '\'')
+	if end < 0 {
+		return len(text)
+	}
+	return i + end + 2
+}
+
+// skipDoubleQuoted returns the index just past the double-quoted
+// string that starts at text[i]
+func skipDoubleQuoted(text string, i int) int {
+	for i++; i < len(text); {
+		switch text[i] {
+		case '"':
+			return i + 1
+		case '\\':
+			i += 2
+		case '$':
+			i = skipDollar(text, i, true)
+		case '`':
+			i = skipBackquoted(text, i)
+		default:
+			i++
+		}
+	}
+	return len(text)
+}
+
+// skipBackquoted returns the index just past the backquoted command
+// substitution that starts at text[i]
+func skipBackquoted(text string, i int) int {
+	for i++; i < len(text); i++ {
+		switch text[i] {
+		case '`':
+			return i + 1
+		case '\\':
+			i++
+		}
+	}
+	return len(text)
+}
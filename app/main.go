@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 
 	"github.com/chzyer/readline"
 )
@@ -13,11 +15,13 @@ var history = &History{File: os.Getenv("HISTFILE"), MaxLen: math.MaxInt64}
 
 func main() {
 	history.ReadFromFile()
+	catchSignals()
 
 	// Initialize core components
+	state := NewShellState()
 	pathFinder := NewPathFinder()
-	builtins := NewBuiltinCommands(pathFinder, history)
-	executor := NewExecutor(pathFinder, builtins)
+	builtins := NewBuiltinCommands(pathFinder, history, state)
+	executor := NewExecutor(pathFinder, builtins, state)
 
 	// Setup tab completion
 	completer, err := SetupCompleter(builtins, pathFinder)
@@ -31,6 +35,8 @@ func main() {
 		Prompt:       "$ ",
 		AutoComplete: completer,
 		Listener:     completer,
+		// a command read over several lines is saved as one entry
+		DisableAutoSaveHistory: true,
 	})
 
 	completer.rl = rl
@@ -47,18 +53,49 @@ func main() {
 			break
 		}
 
-		history.Write(line)
+		input, ok := readContinuation(rl, line)
+		if !ok {
+			continue
+		}
+
+		history.Write(input)
 
-		input := strings.TrimSpace(line)
-		if input == "" {
+		if strings.TrimSpace(input) == "" {
 			continue
 		}
+		rl.SaveHistory(input)
+
+		executor.Execute(input)
+	}
+}
 
-		output, err := executor.Execute(input)
+// readContinuation keeps reading lines with the secondary prompt while
+// the command is incomplete, for example after an unclosed quote or a
+// trailing |, and returns the whole command. Ctrl+C discards it, which
+// is reported by returning false.
+func readContinuation(rl *readline.Instance, input string) (string, bool) {
+	defer rl.SetPrompt("$ ")
+
+	for !IsComplete(input) {
+		rl.SetPrompt("> ")
+		line, err := rl.Readline()
+		if err == readline.ErrInterrupt {
+			return "", false
+		}
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-		} else if len(output) > 0 {
-			fmt.Println(output)
+			// end of input: run what was read so far
+			break
 		}
+		input += "\n" + line
 	}
+	return input, true
+}
+
+// catchSignals keeps the shell alive for the whole session when Ctrl+C
+// or Ctrl+\ is pressed. The terminal sends them to the shell as well
+// as to the program in the foreground, which they are meant for. They
+// are caught and dropped rather than ignored, because programs would
+// inherit ignored signals and could no longer be interrupted.
+func catchSignals() {
+	signal.Notify(make(chan os.Signal, 1), os.Interrupt, syscall.SIGQUIT)
 }
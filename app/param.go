@@ -0,0 +1,459 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// specialParams are the single-character special parameters
+const specialParams = "?$#@*!-0123456789"
+
+// paramRef is the parameter named at the start of a ${...} expansion
+type paramRef struct {
+	name         string
+	subscript    string
+	hasSubscript bool
+}
+
+// parseParamRef reads the parameter at the start of inner and returns
+// it together with the rest of the text, which holds the operator
+func parseParamRef(inner string) (paramRef, string, bool) {
+	var ref paramRef
+
+	n := 0
+	switch {
+	case inner == "":
+		return ref, "", false
+	case inner[0] >= '0' && inner[0] <= '9':
+		for n < len(inner) && inner[n] >= '0' && inner[n] <= '9' {
+			n++
+		}
+	case isNameChar(inner, 0):
+		for isNameChar(inner, n) {
+			n++
+		}
+	case strings.IndexByte(specialParams, inner[0]) >= 0:
+		n = 1
+	default:
+		return ref, "", false
+	}
+	ref.name, inner = inner[:n], inner[n:]
+
+	if strings.HasPrefix(inner, "[") {
+		end := strings.IndexByte(inner, ']')
+		if end < 0 {
+			return ref, "", false
+		}
+		ref.subscript, ref.hasSubscript = inner[1:end], true
+		inner = inner[end+1:]
+	}
+	return ref, inner, true
+}
+
+// expandBraced expands the inside of ${...}: a parameter, optionally
+// with an array subscript, followed by an optional operator. source is
+// the whole expansion, used in error messages. The word of the -, =
+// and + operators keeps its quoting, so that quoted parts are neither
+// split nor globbed.
+func (e *Executor) expandBraced(inner, source string) (chunks, error) {
+	// ${#} is the number of positional parameters, ${#name} a length
+	if len(inner) > 1 && inner[0] == '#' {
+		if ref, rest, ok := parseParamRef(inner[1:]); ok && rest == "" {
+			values, _, err := e.lookupRef(ref, source)
+			if err != nil {
+				return nil, err
+			}
+			if ref.hasSubscript && (ref.subscript == "@" || ref.subscript == "*") {
+				return valueChunks(strconv.Itoa(len(values))), nil
+			}
+			return valueChunks(strconv.Itoa(len([]rune(strings.Join(values, " "))))), nil
+		}
+	}
+
+	ref, op, ok := parseParamRef(inner)
+	if !ok {
+		return nil, fmt.Errorf("%s: bad substitution", source)
+	}
+
+	values, set, err := e.lookupRef(ref, source)
+	if err != nil {
+		return nil, err
+	}
+	value := strings.Join(values, " ")
+
+	if op == "" {
+		return valueChunks(value), nil
+	}
+
+	// a colon makes the default value operators treat an empty value
+	// like an unset one
+	colon := false
+	if len(op) > 1 && op[0] == ':' && strings.IndexByte("-=?+", op[1]) >= 0 {
+		colon = true
+		op = op[1:]
+	}
+	unset := !set || (colon && value == "")
+
+	switch op[0] {
+	case '-':
+		if unset {
+			return e.expandText(op[1:], tildeWord)
+		}
+		return valueChunks(value), nil
+	case '=':
+		if !unset {
+			return valueChunks(value), nil
+		}
+		if !isName(ref.name) || ref.hasSubscript {
+			return nil, fmt.Errorf("%s: cannot assign in this way", source)
+		}
+		word, err := e.expandText(op[1:], tildeWord)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.state.Vars.Set(ref.name, word.String()); err != nil {
+			return nil, err
+		}
+		return word, nil
+	case '?':
+		if !unset {
+			return valueChunks(value), nil
+		}
+		msg, err := e.expandString(op[1:])
+		if err != nil {
+			return nil, err
+		}
+		if msg == "" {
+			msg = "parameter null or not set"
+		}
+		return nil, fmt.Errorf("%s: %s", ref.name, msg)
+	case '+':
+		if unset {
+			return nil, nil
+		}
+		return e.expandText(op[1:], tildeWord)
+	case '#', '%':
+		longest := len(op) > 1 && op[1] == op[0]
+		word := op[1:]
+		if longest {
+			word = op[2:]
+		}
+		pattern, err := e.expandPattern(word)
+		if err != nil {
+			return nil, err
+		}
+		if op[0] == '#' {
+			return valueChunks(trimPrefix(value, pattern, longest)), nil
+		}
+		return valueChunks(trimSuffix(value, pattern, longest)), nil
+	case '/':
+		value, err = e.replacePattern(value, op[1:])
+	case ':':
+		value, err = e.substring(value, op[1:], source)
+	case '^', ',':
+		value, err = e.convertCase(value, op)
+	default:
+		return nil, fmt.Errorf("%s: bad substitution", source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return valueChunks(value), nil
+}
+
+// valueChunks returns the value of an expansion, which is subject to
+// field splitting
+func valueChunks(value string) chunks {
+	var c chunks
+	c.add(value, false, true)
+	return c
+}
+
+// lookupRef returns the values of a parameter reference and whether
+// the parameter is set
+func (e *Executor) lookupRef(ref paramRef, source string) ([]string, bool, error) {
+	if ref.hasSubscript {
+		values, err := e.lookupArray(ref.name, ref.subscript)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %v", source, err)
+		}
+		return values, len(values) > 0, nil
+	}
+
+	value, ok := e.lookupParam(ref.name)
+	if !ok {
+		return nil, false, nil
+	}
+	return []string{value}, true, nil
+}
+
+// lookupParam returns the value of a special parameter or variable
+// and whether it is set
+func (e *Executor) lookupParam(name string) (string, bool) {
+	switch name {
+	case "?":
+		return strconv.Itoa(e.state.LastStatus), true
+	case "$":
+		return strconv.Itoa(os.Getpid()), true
+	case "#":
+		return "0", true
+	case "0":
+		return os.Args[0], true
+	case "@", "*", "!", "-":
+		return "", false
+	case "PIPESTATUS":
+		return strconv.Itoa(e.state.PipeStatus[0]), true
+	}
+
+	if _, err := strconv.Atoi(name); err == nil {
+		// positional parameters are never set in an interactive shell
+		return "", false
+	}
+	return e.state.Vars.Get(name)
+}
+
+// lookupArray returns the elements of an array selected by subscript:
+// an index, or @ or * for all of them. A scalar variable behaves as an
+// array with a single element.
+func (e *Executor) lookupArray(name, subscript string) ([]string, error) {
+	var values []string
+	if name == "PIPESTATUS" {
+		for _, st := range e.state.PipeStatus {
+			values = append(values, strconv.Itoa(st))
+		}
+	} else if value, ok := e.lookupParam(name); ok {
+		values = []string{value}
+	}
+
+	if subscript == "@" || subscript == "*" {
+		return values, nil
+	}
+
+	n, err := strconv.Atoi(subscript)
+	if err != nil {
+		return nil, fmt.Errorf("bad array subscript")
+	}
+	if n < 0 || n >= len(values) {
+		return nil, nil
+	}
+	return values[n : n+1], nil
+}
+
+// expandPattern expands the pattern word of an operator. Quoted parts
+// of the word match literally.
+func (e *Executor) expandPattern(word string) (string, error) {
+	expanded, err := e.expandText(word, tildeWord)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, ch := range expanded {
+		if ch.quoted {
+			b.WriteString(escapePattern(ch.text))
+		} else {
+			b.WriteString(ch.text)
+		}
+	}
+	return b.String(), nil
+}
+
+// trimPrefix removes the shortest or longest prefix of value that
+// matches pattern
+func trimPrefix(value, pattern string, longest bool) string {
+	r := []rune(value)
+	for i := range len(r) + 1 {
+		n := i
+		if longest {
+			n = len(r) - i
+		}
+		if matchPattern(pattern, string(r[:n])) {
+			return string(r[n:])
+		}
+	}
+	return value
+}
+
+// trimSuffix removes the shortest or longest suffix of value that
+// matches pattern
+func trimSuffix(value, pattern string, longest bool) string {
+	r := []rune(value)
+	for i := range len(r) + 1 {
+		n := len(r) - i
+		if longest {
+			n = i
+		}
+		if matchPattern(pattern, string(r[n:])) {
+			return string(r[:n])
+		}
+	}
+	return value
+}
+
+// replacePattern implements ${var/pat/rep} and its variants. spec is
+// the text after the first slash: a leading / replaces every match,
+// # anchors the pattern at the start and % at the end.
+func (e *Executor) replacePattern(value, spec string) (string, error) {
+	mode := byte(0)
+	if spec != "" && strings.IndexByte("/#%", spec[0]) >= 0 {
+		mode = spec[0]
+		spec = spec[1:]
+	}
+
+	word, rep := spec, ""
+	if i := indexUnquoted(spec, '/'); i >= 0 {
+		word, rep = spec[:i], spec[i+1:]
+	}
+
+	pattern, err := e.expandPattern(word)
+	if err != nil {
+		return "", err
+	}
+	rep, err = e.expandString(rep)
+	if err != nil {
+		return "", err
+	}
+	if pattern == "" && mode != '#' && mode != '%' {
+		return value, nil
+	}
+
+	r := []rune(value)
+	var b strings.Builder
+	for i := 0; i <= len(r); {
+		end := -1
+		if mode != '#' || i == 0 {
+			end = longestMatch(pattern, r, i, mode == '%')
+		}
+		// unanchored patterns only replace non-empty matches
+		if end > i || (end == i && (mode == '#' || mode == '%')) {
+			b.WriteString(rep)
+			if mode != '/' {
+				b.WriteString(string(r[end:]))
+				return b.String(), nil
+			}
+			i = end
+			continue
+		}
+		if i < len(r) {
+			b.WriteRune(r[i])
+		}
+		i++
+	}
+	return b.String(), nil
+}
+
+// longestMatch returns the end of the longest match of pattern that
+// starts at r[start], or -1. With atEnd the match must reach the end.
+func longestMatch(pattern string, r []rune, start int, atEnd bool) int {
+	for end := len(r); end >= start; end-- {
+		if matchPattern(pattern, string(r[start:end])) {
+			return end
+		}
+		if atEnd {
+			break
+		}
+	}
+	return -1
+}
+
+// indexUnquoted returns the index of the first c in text that is not
+// quoted, escaped or inside a nested expansion, or -1
+func indexUnquoted(text string, c byte) int {
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case c:
+			return i
+		case '\\':
+			i += 2
+		case '\'':
+			i = skipSingleQuoted(text, i)
+		case '"':
+			i = skipDoubleQuoted(text, i)
+		case '$':
+			i = skipDollar(text, i, false)
+		default:
+			i++
+		}
+	}
+	return -1
+}
+
+// substring implements ${var:offset} and ${var:offset:length}. A
+// negative offset counts from the end, a negative length gives the
+// end position counted from the end.
+func (e *Executor) substring(value, spec, source string) (string, error) {
+	offExpr, lenExpr, hasLen := strings.Cut(spec, ":")
+
+	r := []rune(value)
+	off, err := e.evalIndex(offExpr)
+	if err != nil {
+		return "", err
+	}
+	if off < 0 {
+		off += len(r)
+	}
+	if off < 0 || off > len(r) {
+		return "", nil
+	}
+
+	end := len(r)
+	if hasLen {
+		length, err := e.evalIndex(lenExpr)
+		if err != nil {
+			return "", err
+		}
+		if length < 0 {
+			end = len(r) + length
+			if end < off {
+				return "", fmt.Errorf("%s: substring expression < 0", strings.TrimSpace(lenExpr))
+			}
+		} else {
+			end = min(off+length, len(r))
+		}
+	}
+	return string(r[off:end]), nil
+}
+
+// evalIndex evaluates the offset or length of a substring expansion
+func (e *Executor) evalIndex(expr string) (int, error) {
+	v, err := e.evalArith(expr)
+	return int(v), err
+}
+
+// convertCase implements ${var^pat}, ${var^^pat}, ${var,pat} and
+// ${var,,pat}: ^ converts to upper case, , to lower case, and a doubled
+// operator converts every matching character instead of the first one
+func (e *Executor) convertCase(value, op string) (string, error) {
+	all := len(op) > 1 && op[1] == op[0]
+	word := op[1:]
+	if all {
+		word = op[2:]
+	}
+
+	pattern, err := e.expandPattern(word)
+	if err != nil {
+		return "", err
+	}
+	if pattern == "" {
+		pattern = "?"
+	}
+
+	convert := unicode.ToUpper
+	if op[0] == ',' {
+		convert = unicode.ToLower
+	}
+
+	r := []rune(value)
+	for i, c := range r {
+		if i > 0 && !all {
+			break
+		}
+		if matchPattern(pattern, string(c)) {
+			r[i] = convert(c)
+		}
+	}
+	return string(r), nil
+}
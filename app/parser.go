@@ -1,6 +1,12 @@
 package main
 
-import "strings"
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
 
 // ParseArgs parses a command string into individual arguments,
 // handling single quotes, double quotes, and escape sequences.
@@ -64,3 +70,634 @@ func ParseArgs(input string) []string {
 
 	return args
 }
+
+// Parser builds a command syntax tree from a token stream
+type Parser struct {
+	input  string
+	tokens []Token
+	pos    int
+}
+
+// Parse tokenizes and parses a complete command line. Errors in the
+// input are returned as a *SyntaxError.
+func Parse(input string) (*List, error) {
+	l := &Lexer{input: input}
+	l.run()
+	if l.err != nil {
+		return nil, l.err
+	}
+
+	p := &Parser{input: input, tokens: l.tokens}
+	return p.parseProgram()
+}
+
+// IsComplete reports whether input forms a complete command or needs
+// more lines: an unclosed quote, a trailing backslash, a trailing |, &&
+// or ||, or a here-document without its delimiter. Input with a syntax
+// error counts as complete so that the error is reported at once.
+func IsComplete(input string) bool {
+	l := &Lexer{input: input}
+	l.run()
+	if l.unterminated {
+		return false
+	}
+
+	p := &Parser{input: input, tokens: l.tokens}
+	_, err := p.parseProgram()
+	var serr *SyntaxError
+	return !errors.As(err, &serr) || !serr.Incomplete
+}
+
+func (p *Parser) peek() Token {
+	return p.tokens[p.pos]
+}
+
+func (p *Parser) next() Token {
+	tok := p.tokens[p.pos]
+	if tok.Kind != TokenEOF {
+		p.pos++
+	}
+	return tok
+}
+
+// skipNewlines consumes the optional newlines allowed after an operator
+func (p *Parser) skipNewlines() {
+	for p.peek().Kind == TokenNewline {
+		p.next()
+	}
+}
+
+// parseProgram parses and-or lists separated by ;, & and newlines
+// until the end of input
+func (p *Parser) parseProgram() (*List, error) {
+	list := &List{}
+
+	for {
+		p.skipNewlines()
+		if p.peek().Kind == TokenEOF {
+			return list, nil
+		}
+
+		andOr, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		item := &ListItem{AndOr: andOr}
+		list.Items = append(list.Items, item)
+
+		switch tok := p.peek(); tok.Kind {
+		case TokenSemi, TokenNewline:
+			p.next()
+		case TokenAmp:
+			p.next()
+			item.Background = true
+		case TokenEOF:
+		default:
+			return nil, p.syntaxError(tok)
+		}
+	}
+}
+
+// parseAndOr parses pipelines joined by && and ||
+func (p *Parser) parseAndOr() (*AndOr, error) {
+	pipeline, err := p.parsePipeline()
+	if err != nil {
+		return nil, err
+	}
+	andOr := &AndOr{Pipelines: []*Pipeline{pipeline}}
+
+	for p.peek().Kind == TokenAndIf || p.peek().Kind == TokenOrIf {
+		op := p.next().Kind
+		p.skipNewlines()
+
+		pipeline, err := p.parsePipeline()
+		if err != nil {
+			return nil, err
+		}
+		andOr.Ops = append(andOr.Ops, op)
+		andOr.Pipelines = append(andOr.Pipelines, pipeline)
+	}
+
+	return andOr, nil
+}
+
+// parsePipeline parses commands joined by |
+func (p *Parser) parsePipeline() (*Pipeline, error) {
+	cmd, err := p.parseCommand()
+	if err != nil {
+		return nil, err
+	}
+	pipeline := &Pipeline{Commands: []CommandNode{cmd}}
+
+	for p.peek().Kind == TokenPipe {
+		p.next()
+		p.skipNewlines()
+
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		pipeline.Commands = append(pipeline.Commands, cmd)
+	}
+
+	return pipeline, nil
+}
+
+// closingWords are the reserved words that end part of a compound
+// command and so cannot start a command
+var closingWords = map[string]bool{
+	"then": true, "elif": true, "else": true, "fi": true,
+	"do": true, "done": true, "esac": true, "}": true,
+}
+
+// parseCommand parses a compound command, an arithmetic command or a
+// simple command
+func (p *Parser) parseCommand() (CommandNode, error) {
+	tok := p.peek()
+	switch {
+	case tok.Kind == TokenArith:
+		return p.parseArith()
+	case isReserved(tok, "if"):
+		return p.parseIf()
+	case isReserved(tok, "while", "until"):
+		return p.parseLoop()
+	case isReserved(tok, "for"):
+		return p.parseFor()
+	case isReserved(tok, "case"):
+		return p.parseCase()
+	case isReserved(tok, "{"):
+		return p.parseGroup()
+	case tok.Kind == TokenWord && closingWords[tok.Text]:
+		return nil, p.syntaxError(tok)
+	}
+	return p.parseSimple()
+}
+
+// parseSimple parses a simple command: words and redirections in any
+// order
+func (p *Parser) parseSimple() (CommandNode, error) {
+	cmd := &SimpleCommand{}
+
+	for {
+		tok := p.peek()
+		switch {
+		case tok.Kind == TokenWord && len(cmd.Args) == 0 && isAssignment(tok):
+			cmd.Assigns = append(cmd.Assigns, p.next())
+		case tok.Kind == TokenWord:
+			cmd.Args = append(cmd.Args, p.next())
+		case tok.IsRedirect():
+			r, err := p.parseRedirect()
+			if err != nil {
+				return nil, err
+			}
+			cmd.Redirects = append(cmd.Redirects, r)
+		default:
+			if len(cmd.Args) == 0 && len(cmd.Assigns) == 0 && len(cmd.Redirects) == 0 {
+				if tok.Kind == TokenEOF {
+					return nil, p.unexpectedEOF(tok)
+				}
+				return nil, p.syntaxError(tok)
+			}
+			return cmd, nil
+		}
+	}
+}
+
+// parseArith parses an arithmetic command and its redirections
+func (p *Parser) parseArith() (CommandNode, error) {
+	tok := p.next()
+	if !strings.HasSuffix(tok.Text, "))") {
+		return nil, p.syntaxError(p.peek())
+	}
+	cmd := &ArithCommand{Expr: tok.Value}
+
+	var err error
+	cmd.Redirects, err = p.parseRedirects()
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseIf parses if list; then list; [elif list; then list;]...
+// [else list;] fi
+func (p *Parser) parseIf() (CommandNode, error) {
+	p.next()
+	cmd := &IfCommand{}
+
+	for {
+		cond, err := p.parseCompoundList("then")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expectReserved("then"); err != nil {
+			return nil, err
+		}
+		body, err := p.parseCompoundList("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		cmd.Conds = append(cmd.Conds, cond)
+		cmd.Bodies = append(cmd.Bodies, body)
+
+		word, err := p.expectReserved("elif", "else", "fi")
+		if err != nil {
+			return nil, err
+		}
+		if word == "elif" {
+			continue
+		}
+
+		if word == "else" {
+			if cmd.Else, err = p.parseCompoundList("fi"); err != nil {
+				return nil, err
+			}
+			if _, err := p.expectReserved("fi"); err != nil {
+				return nil, err
+			}
+		}
+		break
+	}
+
+	var err error
+	cmd.Redirects, err = p.parseRedirects()
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseLoop parses while list; do list; done and the same with until
+func (p *Parser) parseLoop() (CommandNode, error) {
+	cmd := &LoopCommand{Until: p.next().Text == "until"}
+
+	var err error
+	if cmd.Cond, err = p.parseCompoundList("do"); err != nil {
+		return nil, err
+	}
+	if cmd.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	if cmd.Redirects, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseFor parses for name [in words]; do list; done and the
+// arithmetic for ((init; cond; step)); do list; done
+func (p *Parser) parseFor() (CommandNode, error) {
+	p.next()
+	if p.peek().Kind == TokenArith {
+		return p.parseArithFor()
+	}
+
+	name := p.peek()
+	if name.Kind != TokenWord || !isName(name.Text) {
+		return nil, p.unexpected(name)
+	}
+	p.next()
+	cmd := &ForCommand{Name: name.Text}
+
+	p.skipNewlines()
+	if isReserved(p.peek(), "in") {
+		p.next()
+		for p.peek().Kind == TokenWord {
+			cmd.Words = append(cmd.Words, p.next())
+		}
+		if tok := p.peek(); tok.Kind != TokenSemi && tok.Kind != TokenNewline {
+			return nil, p.unexpected(tok)
+		}
+		p.next()
+	} else if p.peek().Kind == TokenSemi {
+		p.next()
+	}
+	p.skipNewlines()
+
+	var err error
+	if cmd.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	if cmd.Redirects, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseArithFor parses the rest of an arithmetic for loop, from the
+// ((init; cond; step)) part
+func (p *Parser) parseArithFor() (CommandNode, error) {
+	tok := p.next()
+	parts := strings.Split(tok.Value, ";")
+	if !strings.HasSuffix(tok.Text, "))") || len(parts) != 3 {
+		return nil, p.syntaxError(tok)
+	}
+	cmd := &ArithForCommand{Init: parts[0], Cond: parts[1], Step: parts[2]}
+
+	if p.peek().Kind == TokenSemi {
+		p.next()
+	}
+	p.skipNewlines()
+
+	var err error
+	if cmd.Body, err = p.parseDoGroup(); err != nil {
+		return nil, err
+	}
+	if cmd.Redirects, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseDoGroup parses the do list; done body of a loop
+func (p *Parser) parseDoGroup() (*List, error) {
+	if _, err := p.expectReserved("do"); err != nil {
+		return nil, err
+	}
+	body, err := p.parseCompoundList("done")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expectReserved("done"); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// parseCase parses case word in [(]pattern[|pattern]...) list;; ... esac.
+// The ;; after the last clause may be left out.
+func (p *Parser) parseCase() (CommandNode, error) {
+	p.next()
+	word := p.peek()
+	if word.Kind != TokenWord {
+		return nil, p.unexpected(word)
+	}
+	p.next()
+	cmd := &CaseCommand{Word: word}
+
+	p.skipNewlines()
+	if _, err := p.expectReserved("in"); err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipNewlines()
+		if isReserved(p.peek(), "esac") {
+			p.next()
+			break
+		}
+
+		item, err := p.parseCaseItem()
+		if err != nil {
+			return nil, err
+		}
+		cmd.Items = append(cmd.Items, item)
+
+		tok := p.peek()
+		if isReserved(tok, "esac") {
+			p.next()
+			break
+		}
+		if tok.Kind != TokenDSemi {
+			return nil, p.unexpected(tok)
+		}
+		p.next()
+	}
+
+	var err error
+	if cmd.Redirects, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseCaseItem parses the patterns and body of one case clause
+func (p *Parser) parseCaseItem() (*CaseItem, error) {
+	item := &CaseItem{}
+	if p.peek().Kind == TokenLParen {
+		p.next()
+	}
+
+	for {
+		tok := p.peek()
+		if tok.Kind != TokenWord {
+			return nil, p.unexpected(tok)
+		}
+		item.Patterns = append(item.Patterns, p.next())
+		if p.peek().Kind != TokenPipe {
+			break
+		}
+		p.next()
+	}
+	if tok := p.peek(); tok.Kind != TokenRParen {
+		return nil, p.unexpected(tok)
+	}
+	p.next()
+
+	// a clause may have an empty body
+	p.skipNewlines()
+	if tok := p.peek(); tok.Kind == TokenDSemi || isReserved(tok, "esac") {
+		item.Body = &List{}
+		return item, nil
+	}
+
+	var err error
+	item.Body, err = p.parseCompoundList("esac")
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// parseGroup parses { list; }
+func (p *Parser) parseGroup() (CommandNode, error) {
+	p.next()
+	cmd := &GroupCommand{}
+
+	var err error
+	if cmd.Body, err = p.parseCompoundList("}"); err != nil {
+		return nil, err
+	}
+	if _, err := p.expectReserved("}"); err != nil {
+		return nil, err
+	}
+	if cmd.Redirects, err = p.parseRedirects(); err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// parseCompoundList parses the list inside a compound command. It
+// stops before one of the reserved words ends, which are only
+// recognised where a command could start, or before ;; in a case
+// clause. The list may not be empty.
+func (p *Parser) parseCompoundList(ends ...string) (*List, error) {
+	list := &List{}
+
+	for {
+		p.skipNewlines()
+		tok := p.peek()
+		if isReserved(tok, ends...) || tok.Kind == TokenDSemi {
+			if len(list.Items) == 0 {
+				return nil, p.syntaxError(tok)
+			}
+			return list, nil
+		}
+		if tok.Kind == TokenEOF {
+			return nil, p.unexpectedEOF(tok)
+		}
+
+		andOr, err := p.parseAndOr()
+		if err != nil {
+			return nil, err
+		}
+		item := &ListItem{AndOr: andOr}
+		list.Items = append(list.Items, item)
+
+		switch tok := p.peek(); {
+		case tok.Kind == TokenSemi || tok.Kind == TokenNewline:
+			p.next()
+		case tok.Kind == TokenAmp:
+			p.next()
+			item.Background = true
+		case isReserved(tok, ends...) || tok.Kind == TokenDSemi:
+		default:
+			return nil, p.unexpected(tok)
+		}
+	}
+}
+
+// expectReserved consumes the next token, which must be one of the
+// reserved words, and returns it
+func (p *Parser) expectReserved(words ...string) (string, error) {
+	tok := p.peek()
+	if !isReserved(tok, words...) {
+		return "", p.unexpected(tok)
+	}
+	p.next()
+	return tok.Text, nil
+}
+
+// parseRedirects parses the redirections that follow a command
+func (p *Parser) parseRedirects() ([]*Redirect, error) {
+	var redirects []*Redirect
+	for p.peek().IsRedirect() {
+		r, err := p.parseRedirect()
+		if err != nil {
+			return nil, err
+		}
+		redirects = append(redirects, r)
+	}
+	return redirects, nil
+}
+
+// parseRedirect parses a redirection operator and its target word
+func (p *Parser) parseRedirect() (*Redirect, error) {
+	tok := p.next()
+	target := p.peek()
+	if target.Kind != TokenWord {
+		return nil, p.syntaxError(target)
+	}
+	p.next()
+	return &Redirect{Op: tok.Kind, Fd: tok.Fd, Target: target}, nil
+}
+
+// isReserved reports whether tok is one of the reserved words. Only
+// an unquoted word spelt exactly like one is reserved.
+func isReserved(tok Token, words ...string) bool {
+	return tok.Kind == TokenWord && slices.Contains(words, tok.Text)
+}
+
+// isAssignment reports whether a word has the form NAME=value with an
+// unquoted name
+func isAssignment(tok Token) bool {
+	_, ok := assignmentName(tok.Text)
+	return ok
+}
+
+// SyntaxError describes input that cannot be parsed. Line and Column
+// locate the problem, counting from 1.
+type SyntaxError struct {
+	Line   int
+	Column int
+	// Token is the unexpected token, or empty when the input ended
+	// too early
+	Token string
+	// Msg replaces the standard message when Token is empty
+	Msg string
+	// Incomplete is set when more input could complete the command
+	Incomplete bool
+	// Source is the line of input the error is on
+	Source string
+}
+
+func (e *SyntaxError) Error() string {
+	if e.Token == "" {
+		return e.Msg
+	}
+	return fmt.Sprintf("syntax error near unexpected token `%s'", e.Token)
+}
+
+// Caret returns the offending line with a caret under the column of
+// the error on the line below it
+func (e *SyntaxError) Caret() string {
+	// tabs are kept so that the caret lines up with the text above it
+	var pad strings.Builder
+	for _, c := range []rune(e.Source)[:e.Column-1] {
+		if c == '\t' {
+			pad.WriteRune(c)
+		} else {
+			pad.WriteByte(' ')
+		}
+	}
+	return e.Source + "\n" + pad.String() + "^"
+}
+
+// newSyntaxError returns a syntax error at byte offset pos of input
+func newSyntaxError(input string, pos int) *SyntaxError {
+	start := strings.LastIndexByte(input[:pos], '\n') + 1
+	end := strings.IndexByte(input[start:], '\n')
+	if end < 0 {
+		end = len(input)
+	} else {
+		end += start
+	}
+	// the newline that ends a line counts as its last column
+	if pos > end {
+		pos = end
+	}
+
+	return &SyntaxError{
+		Line:   strings.Count(input[:start], "\n") + 1,
+		Column: utf8.RuneCountInString(input[start:pos]) + 1,
+		Source: input[start:end],
+	}
+}
+
+// syntaxError reports an unexpected token
+func (p *Parser) syntaxError(tok Token) error {
+	err := newSyntaxError(p.input, tok.Pos)
+	err.Token = tok.Text
+	if tok.Kind == TokenNewline || tok.Kind == TokenEOF {
+		err.Token = "newline"
+	}
+	return err
+}
+
+// unexpected reports tok as an unexpected token, or the end of input
+// if there are no tokens left
+func (p *Parser) unexpected(tok Token) error {
+	if tok.Kind == TokenEOF {
+		return p.unexpectedEOF(tok)
+	}
+	return p.syntaxError(tok)
+}
+
+// unexpectedEOF reports input that ends where the command must go on,
+// such as after | or &&
+func (p *Parser) unexpectedEOF(tok Token) error {
+	err := newSyntaxError(p.input, tok.Pos)
+	err.Msg = "syntax error: unexpected end of file"
+	err.Incomplete = true
+	return err
+}
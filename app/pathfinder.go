@@ -4,24 +4,38 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 // PathFinder handles PATH resolution and executable lookup
 type PathFinder struct {
+	mu    sync.RWMutex
 	paths []string
 }
 
 // NewPathFinder creates a new PathFinder with the system PATH
 func NewPathFinder() *PathFinder {
-	return &PathFinder{
-		paths: strings.Split(os.Getenv("PATH"), string(os.PathListSeparator)),
+	pf := &PathFinder{}
+	pf.SetPath(os.Getenv("PATH"))
+	return pf
+}
+
+// SetPath replaces the directories searched with those of a PATH value
+func (pf *PathFinder) SetPath(path string) {
+	var paths []string
+	if path != "" {
+		paths = strings.Split(path, string(os.PathListSeparator))
 	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.paths = paths
 }
 
 // FindExecutable searches for a command in PATH directories
 // Returns the full path if found, empty string otherwise
 func (pf *PathFinder) FindExecutable(command string) string {
-	for _, p := range pf.paths {
+	for _, p := range pf.GetPaths() {
 		fp := filepath.Join(p, command)
 		if info, err := os.Stat(fp); err == nil && info.Mode().IsRegular() && (info.Mode()&0111 != 0) {
 			return fp
@@ -34,7 +48,7 @@ func (pf *PathFinder) FindExecutable(command string) string {
 func (pf *PathFinder) FetchAllExecutables() []string {
 	executables := make(map[string]struct{})
 
-	for _, path := range pf.paths {
+	for _, path := range pf.GetPaths() {
 		entries, err := os.ReadDir(path)
 		if err != nil {
 			continue // skip if cannot read
@@ -67,5 +81,7 @@ func (pf *PathFinder) FetchAllExecutables() []string {
 
 // GetPaths returns the list of PATH directories
 func (pf *PathFinder) GetPaths() []string {
+	pf.mu.RLock()
+	defer pf.mu.RUnlock()
 	return pf.paths
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// matchPattern reports whether s as a whole matches the shell pattern.
+// Patterns support *, ?, bracket expressions such as [a-z], [!0-9] and
+// [[:alpha:]], and backslash to take the next character literally.
+func matchPattern(pattern, s string) bool {
+	p, r := []rune(pattern), []rune(s)
+	pi, si := 0, 0
+
+	// position of the last * seen and the input it was tried against
+	starP, starS := -1, 0
+
+	for si < len(r) {
+		if pi < len(p) && p[pi] == '*' {
+			starP, starS = pi, si
+			pi++
+			continue
+		}
+		if pi < len(p) {
+			if next, ok := matchOne(p, pi, r[si]); ok {
+				pi, si = next, si+1
+				continue
+			}
+		}
+		// let the last * swallow one more character and retry
+		if starP < 0 {
+			return false
+		}
+		starS++
+		pi, si = starP+1, starS
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// matchOne matches the single-character pattern element at p[pi]
+// against c and returns the index of the next element
+func matchOne(p []rune, pi int, c rune) (int, bool) {
+	switch p[pi] {
+	case '?':
+		return pi + 1, true
+	case '[':
+		if end, ok := bracketEnd(p, pi); ok {
+			return end, matchBracket(p[pi+1:end-1], c)
+		}
+	case '\\':
+		if pi+1 < len(p) {
+			return pi + 2, p[pi+1] == c
+		}
+	}
+	return pi + 1, p[pi] == c
+}
+
+// bracketEnd returns the index just past the bracket expression that
+// starts at p[pi]. An unterminated [ is an ordinary character.
+func bracketEnd(p []rune, pi int) (int, bool) {
+	j := pi + 1
+	if j < len(p) && (p[j] == '!' || p[j] == '^') {
+		j++
+	}
+	// a ] right after the opening bracket is part of the set
+	if j < len(p) && p[j] == ']' {
+		j++
+	}
+
+	for j < len(p) {
+		switch {
+		case p[j] == ']':
+			return j + 1, true
+		case p[j] == '[' && j+1 < len(p) && p[j+1] == ':':
+			if end := classEnd(p, j+2); end >= 0 {
+				j = end + 2
+			} else {
+				j++
+			}
+		case p[j] == '\\':
+			j += 2
+		default:
+			j++
+		}
+	}
+	return 0, false
+}
+
+// classEnd returns the index of the :] that closes a character class
+// name starting at p[i], or -1
+func classEnd(p []rune, i int) int {
+	for ; i+1 < len(p); i++ {
+		if p[i] == ':' && p[i+1] == ']' {
+			return i
+		}
+	}
+	return -1
+}
+
+// matchBracket reports whether c is in the set of a bracket expression,
+// given without its enclosing brackets
+func matchBracket(set []rune, c rune) bool {
+	negate := len(set) > 0 && (set[0] == '!' || set[0] == '^')
+	if negate {
+		set = set[1:]
+	}
+
+	matched := false
+	for i := 0; i < len(set); {
+		if set[i] == '[' && i+1 < len(set) && set[i+1] == ':' {
+			if end := classEnd(set, i+2); end >= 0 {
+				if matchClass(string(set[i+2:end]), c) {
+					matched = true
+				}
+				i = end + 2
+				continue
+			}
+		}
+
+		lo := set[i]
+		if lo == '\\' && i+1 < len(set) {
+			i++
+			lo = set[i]
+		}
+		i++
+
+		hi := lo
+		if i+1 < len(set) && set[i] == '-' {
+			hi = set[i+1]
+			if hi == '\\' && i+2 < len(set) {
+				i++
+				hi = set[i+1]
+			}
+			i += 2
+		}
+
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	return matched != negate
+}
+
+// matchClass reports whether c belongs to a named character class such
+// as alpha or digit
+func matchClass(class string, c rune) bool {
+	switch class {
+	case "alnum":
+		return unicode.IsLetter(c) || unicode.IsDigit(c)
+	case "alpha":
+		return unicode.IsLetter(c)
+	case "blank":
+		return c == ' ' || c == '\t'
+	case "cntrl":
+		return unicode.IsControl(c)
+	case "digit":
+		return c >= '0' && c <= '9'
+	case "graph":
+		return unicode.IsGraphic(c) && !unicode.IsSpace(c)
+	case "lower":
+		return unicode.IsLower(c)
+	case "print":
+		return unicode.IsPrint(c)
+	case "punct":
+		return unicode.IsPunct(c) || unicode.IsSymbol(c)
+	case "space":
+		return unicode.IsSpace(c)
+	case "upper":
+		return unicode.IsUpper(c)
+	case "word":
+		return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+	case "xdigit":
+		return strings.ContainsRune("0123456789abcdefABCDEF", c)
+	}
+	return false
+}
+
+// escapePattern quotes the characters of s that are special in
+// patterns, so that s only matches itself
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// fdEntry is the stream behind an open file descriptor. Files opened
+// for reading and writing set both ends.
+type fdEntry struct {
+	r io.Reader
+	w io.Writer
+}
+
+// fdTable maps the file descriptors a command sees to their streams.
+// Redirections work on a copy, so they only affect the command they
+// are attached to.
+type fdTable map[int]fdEntry
+
+// newFdTable creates a table with the three standard descriptors
+func newFdTable(stdin io.Reader, stdout, stderr io.Writer) fdTable {
+	return fdTable{
+		0: {r: stdin},
+		1: {w: stdout},
+		2: {w: stderr},
+	}
+}
+
+func (t fdTable) clone() fdTable {
+	c := make(fdTable, len(t))
+	for fd, entry := range t {
+		c[fd] = entry
+	}
+	return c
+}
+
+// reader returns the stream to read fd from. A closed descriptor
+// reads as empty.
+func (t fdTable) reader(fd int) io.Reader {
+	if r := t[fd].r; r != nil {
+		return r
+	}
+	return strings.NewReader("")
+}
+
+// writer returns the stream to write fd to. Writes to a closed
+// descriptor fail with EBADF.
+func (t fdTable) writer(fd int) io.Writer {
+	if w := t[fd].w; w != nil {
+		return w
+	}
+	return closedWriter{}
+}
+
+// closedWriter is the stream of a closed descriptor
+type closedWriter struct{}
+
+func (closedWriter) Write(p []byte) (int, error) {
+	return 0, syscall.EBADF
+}
+
+// errWriter remembers the first error a write to w failed with, so
+// that commands which ignore it can still be reported as failed
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	n, err := e.w.Write(p)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// fail reports err on the table's stderr and returns status
+func (t fdTable) fail(err error, status int) int {
+	fmt.Fprintln(t.writer(2), err)
+	return status
+}
+
+// file returns the OS file behind fd, if any, so it can be inherited
+// by a child process
+func (t fdTable) file(fd int) *os.File {
+	entry := t[fd]
+	if f, ok := entry.w.(*os.File); ok {
+		return f
+	}
+	if f, ok := entry.r.(*os.File); ok {
+		return f
+	}
+	return nil
+}
+
+// extraFiles returns the descriptors above 2 in the form exec.Cmd
+// expects: index i holds descriptor 3+i
+func (t fdTable) extraFiles() []*os.File {
+	max := 2
+	for fd := range t {
+		if fd > max && t.file(fd) != nil {
+			max = fd
+		}
+	}
+
+	var files []*os.File
+	for fd := 3; fd <= max; fd++ {
+		files = append(files, t.file(fd))
+	}
+	return files
+}
+
+// dup returns a copy of the table with its own duplicates of the OS
+// files in it, which stay open when the originals are closed. The
+// caller closes the returned duplicates once it is done with them.
+func (t fdTable) dup() (fdTable, []*os.File, error) {
+	c := t.clone()
+	dups := make(map[*os.File]*os.File)
+	var files []*os.File
+
+	get := func(f *os.File) (*os.File, error) {
+		if d, ok := dups[f]; ok {
+			return d, nil
+		}
+		d, err := dupFile(f)
+		if err != nil {
+			return nil, err
+		}
+		dups[f] = d
+		files = append(files, d)
+		return d, nil
+	}
+
+	for fd, entry := range c {
+		var err error
+		if f, ok := entry.r.(*os.File); ok {
+			entry.r, err = get(f)
+		}
+		if f, ok := entry.w.(*os.File); ok && err == nil {
+			entry.w, err = get(f)
+		}
+		if err != nil {
+			closeFiles(files)
+			return nil, nil, err
+		}
+		c[fd] = entry
+	}
+	return c, files, nil
+}
+
+// syncWriter serializes writes to a writer that is shared by commands
+// running concurrently, such as the stages of a pipeline
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// synchronized returns a copy of the table in which writers that are
+// not OS files are safe for concurrent use. Descriptors sharing a
+// writer keep sharing it, so 2>&1 still preserves ordering.
+func (t fdTable) synchronized() fdTable {
+	c := t.clone()
+	wrapped := make(map[io.Writer]*syncWriter)
+
+	for fd, entry := range c {
+		switch entry.w.(type) {
+		case nil, *os.File, *syncWriter:
+			continue
+		}
+
+		sw, ok := wrapped[entry.w]
+		if !ok {
+			sw = &syncWriter{w: entry.w}
+			wrapped[entry.w] = sw
+		}
+		entry.w = sw
+		c[fd] = entry
+	}
+	return c
+}
+
+// defaultFd returns the descriptor a redirection applies to when no
+// IO number was given
+func (r *Redirect) defaultFd() int {
+	if r.Fd >= 0 {
+		return r.Fd
+	}
+	switch r.Op {
+	case TokenLess, TokenLessAnd, TokenLessGreat, TokenDLess, TokenDLessDash, TokenTLess:
+		return 0
+	}
+	return 1
+}
+
+// redirectFlags are the open flags of the redirections that open files
+var redirectFlags = map[TokenKind]int{
+	TokenLess:      os.O_RDONLY,
+	TokenGreat:     os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	TokenClobber:   os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	TokenDGreat:    os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+	TokenLessGreat: os.O_RDWR | os.O_CREATE,
+	TokenAndGreat:  os.O_WRONLY | os.O_CREATE | os.O_TRUNC,
+	TokenAndDGreat: os.O_WRONLY | os.O_CREATE | os.O_APPEND,
+}
+
+// applyRedirects applies redirections left to right on a copy of fds.
+// The files it opened are returned so the caller can close them once
+// the command has finished.
+func (e *Executor) applyRedirects(fds fdTable, redirects []*Redirect) (fdTable, []*os.File, error) {
+	if len(redirects) == 0 {
+		return fds, nil, nil
+	}
+
+	fds = fds.clone()
+	var opened []*os.File
+
+	for _, r := range redirects {
+		fd := r.defaultFd()
+
+		if r.Op == TokenDLess || r.Op == TokenDLessDash || r.Op == TokenTLess {
+			f, err := e.openHeredoc(r)
+			if err != nil {
+				closeFiles(opened)
+				return nil, nil, err
+			}
+			opened = append(opened, f)
+			fds[fd] = fdEntry{r: f}
+			continue
+		}
+
+		target, err := e.expandWord(r.Target)
+		if err != nil {
+			closeFiles(opened)
+			return nil, nil, err
+		}
+
+		op := r.Op
+		if op == TokenGreatAnd && r.Fd < 0 && !isDupTarget(target) {
+			// bash treats >&file like &>file
+			op = TokenAndGreat
+		}
+
+		if op == TokenGreatAnd || op == TokenLessAnd {
+			if err := dupFd(fds, fd, target); err != nil {
+				closeFiles(opened)
+				return nil, nil, err
+			}
+			continue
+		}
+
+		f, err := os.OpenFile(e.state.Path(target), redirectFlags[op], 0644)
+		if err != nil {
+			closeFiles(opened)
+			return nil, nil, fmt.Errorf("%s: %s", target, osErrorText(err))
+		}
+		opened = append(opened, f)
+
+		switch op {
+		case TokenLess:
+			fds[fd] = fdEntry{r: f}
+		case TokenLessGreat:
+			fds[fd] = fdEntry{r: f, w: f}
+		case TokenAndGreat, TokenAndDGreat:
+			fds[1] = fdEntry{w: f}
+			fds[2] = fdEntry{w: f}
+		default:
+			fds[fd] = fdEntry{w: f}
+		}
+	}
+
+	return fds, opened, nil
+}
+
+// openHeredoc returns a file to read the content of a here-document or
+// here-string from. The body of a here-document is expanded unless
+// its delimiter was quoted; a here-string is its expanded word
+// followed by a newline.
+func (e *Executor) openHeredoc(r *Redirect) (*os.File, error) {
+	var body string
+	var err error
+	switch {
+	case r.Op == TokenTLess:
+		body, err = e.expandWord(r.Target)
+		body += "\n"
+	case r.Target.Quoted:
+		body = r.Target.Body
+	default:
+		body, err = e.expandHeredoc(r.Target.Body)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A temporary file rather than a pipe can be read by any command,
+	// however large the body is, and is removed once it is closed
+	f, err := os.CreateTemp("", "heredoc")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	if _, err := f.WriteString(body); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// isDupTarget reports whether word names a descriptor to duplicate or
+// is - to close one
+func isDupTarget(word string) bool {
+	if word == "-" {
+		return true
+	}
+	_, err := strconv.Atoi(word)
+	return err == nil
+}
+
+// dupFd applies n>&word and n<&word: word is either a descriptor to
+// duplicate onto fd or - to close fd
+func dupFd(fds fdTable, fd int, target string) error {
+	if target == "-" {
+		delete(fds, fd)
+		return nil
+	}
+
+	src, err := strconv.Atoi(target)
+	if err != nil {
+		return fmt.Errorf("%s: ambiguous redirect", target)
+	}
+
+	entry, ok := fds[src]
+	if !ok {
+		return fmt.Errorf("%d: Bad file descriptor", src)
+	}
+	fds[fd] = entry
+	return nil
+}
+
+// dupFile duplicates the descriptor of f. Like the files Go opens, the
+// duplicate is closed when a program is executed.
+func dupFile(f *os.File) (*os.File, error) {
+	conn, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var fd int
+	var dupErr error
+	err = conn.Control(func(old uintptr) {
+		syscall.ForkLock.RLock()
+		defer syscall.ForkLock.RUnlock()
+		if fd, dupErr = syscall.Dup(int(old)); dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", f.Name(), err)
+	}
+	return os.NewFile(uintptr(fd), f.Name()), nil
+}
+
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+	}
+}
+
+// osErrorText returns the system error message of err the way shells
+// print it, e.g. "No such file or directory"
+func osErrorText(err error) string {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	text := err.Error()
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
@@ -2,24 +2,42 @@ package main
 
 import (
 	"bytes"
+	"io"
 	"os"
+	"os/signal"
+	"os/user"
 	"reflect"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // Helper function to create test executor
 func newTestExecutor() *Executor {
 	pathFinder := NewPathFinder()
 	hist := &History{File: "", Items: []string{}, MaxLen: 100}
-	builtins := NewBuiltinCommands(pathFinder, hist)
-	return NewExecutor(pathFinder, builtins)
+	state := NewShellState()
+	builtins := NewBuiltinCommands(pathFinder, hist, state)
+	return NewExecutor(pathFinder, builtins, state)
+}
+
+// executeCapture runs a command line and returns exactly what it wrote
+// to stdout and stderr
+func executeCapture(executor *Executor, input string) (string, string) {
+	var stdout, stderr bytes.Buffer
+	executor.Stdout = &stdout
+	executor.Stderr = &stderr
+	executor.Execute(input)
+	return stdout.String(), stderr.String()
 }
 
 // echo
 func TestRunCommandEcho(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("echo Hello World")
-	want := "Hello World"
+	got, _ := executeCapture(executor, "echo Hello World")
+	want := "Hello World\n"
 
 	if got != want {
 		t.Errorf("echo: got %q, want %q", got, want)
@@ -28,8 +46,8 @@ func TestRunCommandEcho(t *testing.T) {
 
 func TestRunCommandEchoEmpty(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("echo")
-	want := ""
+	got, _ := executeCapture(executor, "echo")
+	want := "\n"
 
 	if got != want {
 		t.Errorf("echo empty: got %q, want %q", got, want)
@@ -39,19 +57,19 @@ func TestRunCommandEchoEmpty(t *testing.T) {
 // unknown
 func TestRunCommandUnknown(t *testing.T) {
 	executor := newTestExecutor()
-	_, err := executor.Execute("foobar")
-	want := "foobar: command not found"
+	_, got := executeCapture(executor, "foobar")
+	want := "foobar: command not found\n"
 
-	if err == nil || err.Error() != want {
-		t.Errorf("unknown: got %v, want %q", err, want)
+	if got != want || executor.state.LastStatus != 127 {
+		t.Errorf("unknown: got %q (status %d), want %q", got, executor.state.LastStatus, want)
 	}
 }
 
 // type
 func TestRunCommandTypeInvalid(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("type invalid_command")
-	want := "invalid_command: not found"
+	got, _ := executeCapture(executor, "type invalid_command")
+	want := "invalid_command: not found\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -60,8 +78,8 @@ func TestRunCommandTypeInvalid(t *testing.T) {
 
 func TestRunCommandTypeEcho(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("type echo")
-	want := "echo is a shell builtin"
+	got, _ := executeCapture(executor, "type echo")
+	want := "echo is a shell builtin\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -70,7 +88,7 @@ func TestRunCommandTypeEcho(t *testing.T) {
 
 func TestRunCommandTypeEmpty(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("type ")
+	got, _ := executeCapture(executor, "type ")
 	want := ""
 
 	if got != want {
@@ -80,8 +98,8 @@ func TestRunCommandTypeEmpty(t *testing.T) {
 
 func TestRunCommandTypeExecutableFile(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("type cat")
-	want := "cat is /bin/cat"
+	got, _ := executeCapture(executor, "type cat")
+	want := "cat is /bin/cat\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -90,8 +108,8 @@ func TestRunCommandTypeExecutableFile(t *testing.T) {
 
 func TestRunCommandTypeNonExist(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("type abc")
-	want := "abc: not found"
+	got, _ := executeCapture(executor, "type abc")
+	want := "abc: not found\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -100,8 +118,8 @@ func TestRunCommandTypeNonExist(t *testing.T) {
 
 func TestExecuteScript(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("ls .")
-	want := "main.go\nshell_test.go"
+	got, _ := executeCapture(executor, "ls .")
+	want := "main.go\nshell_test.go\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -110,8 +128,8 @@ func TestExecuteScript(t *testing.T) {
 
 func TestTypePwd(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("type pwd")
-	want := "pwd is a shell builtin"
+	got, _ := executeCapture(executor, "type pwd")
+	want := "pwd is a shell builtin\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -120,8 +138,8 @@ func TestTypePwd(t *testing.T) {
 
 func TestPwd(t *testing.T) {
 	executor := newTestExecutor()
-	got, _ := executor.Execute("pwd")
-	want := "/Users/xiaoyuelyu/go/codecrafters-shell-go/app"
+	got, _ := executeCapture(executor, "pwd")
+	want := "/Users/xiaoyuelyu/go/codecrafters-shell-go/app\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -130,19 +148,19 @@ func TestPwd(t *testing.T) {
 
 func TestGoToNonExistentAbsoultePath(t *testing.T) {
 	executor := newTestExecutor()
-	_, err := executor.Execute("cd /Users/agnes")
-	want := "cd: /Users/agnes: No such file or directory"
+	_, got := executeCapture(executor, "cd /Users/agnes")
+	want := "cd: /Users/agnes: No such file or directory\n"
 
-	if err == nil || err.Error() != want {
-		t.Errorf("type: got %v, want %q", err, want)
+	if got != want {
+		t.Errorf("type: got %q, want %q", got, want)
 	}
 }
 
 func TestGoToAbsolutePath(t *testing.T) {
 	executor := newTestExecutor()
-	executor.Execute("cd /Users/xiaoyuelyu")
-	got, _ := executor.Execute("pwd")
-	want := "/Users/xiaoyuelyu"
+	executeCapture(executor, "cd /Users/xiaoyuelyu")
+	got, _ := executeCapture(executor, "pwd")
+	want := "/Users/xiaoyuelyu\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -151,9 +169,9 @@ func TestGoToAbsolutePath(t *testing.T) {
 
 func TestGoToRelativePath(t *testing.T) {
 	executor := newTestExecutor()
-	executor.Execute("cd ../")
-	got, _ := executor.Execute("pwd")
-	want := "/Users/xiaoyuelyu/go/codecrafters-shell-go"
+	executeCapture(executor, "cd ../")
+	got, _ := executeCapture(executor, "pwd")
+	want := "/Users/xiaoyuelyu/go/codecrafters-shell-go\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -162,9 +180,9 @@ func TestGoToRelativePath(t *testing.T) {
 
 func TestGoToHomeDir(t *testing.T) {
 	executor := newTestExecutor()
-	executor.Execute("cd ~")
-	got, _ := executor.Execute("pwd")
-	want := "/Users/xiaoyuelyu"
+	executeCapture(executor, "cd ~")
+	got, _ := executeCapture(executor, "pwd")
+	want := "/Users/xiaoyuelyu\n"
 
 	if got != want {
 		t.Errorf("type: got %q, want %q", got, want)
@@ -246,38 +264,38 @@ func TestSingleQuote(t *testing.T) {
 		{
 			name:    "echo",
 			command: "echo 'Hello        World'",
-			want:    "Hello        World",
+			want:    "Hello        World\n",
 		},
 		{
 			name:    "adjacent quoted and unquoted content",
 			command: "echo hello''world",
-			want:    "helloworld",
+			want:    "helloworld\n",
 		},
 		{
 			name:    "multiple quoted strings",
 			command: "echo 'hello shell' 'example''test' script''world",
-			want:    "hello shell exampletest scriptworld",
+			want:    "hello shell exampletest scriptworld\n",
 		},
 		{
 			name:    "escape character outside quotes 1",
 			command: "echo world\\ \\ \\ \\ \\ \\ script",
-			want:    "world      script",
+			want:    "world      script\n",
 		},
 		{
 			name:    "escape chracter outside quotes 2",
 			command: "echo test\nexample",
-			want:    "testnexample",
+			want:    "testnexample\n",
 		},
 		{
 			name:    "Backslash within double quotes 1",
 			command: "echo \"A \\ escapes itself\"",
-			want:    "A \\ escapes itself",
+			want:    "A \\ escapes itself\n",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, _ := executor.Execute(tt.command)
+			got, _ := executeCapture(executor, tt.command)
 			if got != tt.want {
 				t.Errorf("single quote failed on %#v = %#v, want %#v", tt.command, got, tt.want)
 			}
@@ -289,7 +307,7 @@ func TestSingleQuote(t *testing.T) {
 func TestBuiltinCommandsWithIO(t *testing.T) {
 	pathFinder := NewPathFinder()
 	hist := &History{File: "", Items: []string{}, MaxLen: 100}
-	builtins := NewBuiltinCommands(pathFinder, hist)
+	builtins := NewBuiltinCommands(pathFinder, hist, NewShellState())
 
 	t.Run("echo to buffer", func(t *testing.T) {
 		var buf bytes.Buffer
@@ -304,3 +322,1636 @@ func TestBuiltinCommandsWithIO(t *testing.T) {
 		}
 	})
 }
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		input string
+		kinds []TokenKind
+		texts []string
+	}{
+		{"echo 'a|b'", []TokenKind{TokenWord, TokenWord, TokenEOF}, []string{"echo", "'a|b'", ""}},
+		{"ls|wc -l", []TokenKind{TokenWord, TokenPipe, TokenWord, TokenWord, TokenEOF}, []string{"ls", "|", "wc", "-l", ""}},
+		{"a && b || c ; d &", []TokenKind{TokenWord, TokenAndIf, TokenWord, TokenOrIf, TokenWord, TokenSemi, TokenWord, TokenAmp, TokenEOF}, nil},
+		{"cmd >out >>log 2>err <in", []TokenKind{TokenWord, TokenGreat, TokenWord, TokenDGreat, TokenWord, TokenGreat, TokenWord, TokenLess, TokenWord, TokenEOF}, nil},
+		{"a\nb # comment", []TokenKind{TokenWord, TokenNewline, TokenWord, TokenEOF}, nil},
+		{"echo a2>f", []TokenKind{TokenWord, TokenWord, TokenGreat, TokenWord, TokenEOF}, []string{"echo", "a2", ">", "f", ""}},
+		{"a 2>&1 &>f &>>g <>h >|i 4<&0 >&-", []TokenKind{
+			TokenWord, TokenGreatAnd, TokenWord, TokenAndGreat, TokenWord, TokenAndDGreat, TokenWord,
+			TokenLessGreat, TokenWord, TokenClobber, TokenWord, TokenLessAnd, TokenWord, TokenGreatAnd, TokenWord, TokenEOF,
+		}, []string{"a", "2>&", "1", "&>", "f", "&>>", "g", "<>", "h", ">|", "i", "4<&", "0", ">&", "-", ""}},
+		{"echo ${a:-b c}|x", []TokenKind{TokenWord, TokenWord, TokenPipe, TokenWord, TokenEOF}, []string{"echo", "${a:-b c}", "|", "x", ""}},
+		{"echo $(a | b) `c;d`", []TokenKind{TokenWord, TokenWord, TokenWord, TokenEOF}, []string{"echo", "$(a | b)", "`c;d`", ""}},
+		{"((x = (1+2) > 0)) && y", []TokenKind{TokenArith, TokenAndIf, TokenWord, TokenEOF}, []string{"((x = (1+2) > 0))", "&&", "y", ""}},
+		{"case a in (a|b) x;; esac", []TokenKind{
+			TokenWord, TokenWord, TokenWord, TokenLParen, TokenWord, TokenPipe, TokenWord, TokenRParen, TokenWord, TokenDSemi, TokenWord, TokenEOF,
+		}, nil},
+		{"cat <<EOF <<-'X' <<<w\nbody\nEOF\n\tx\nX\n", []TokenKind{
+			TokenWord, TokenDLess, TokenWord, TokenDLessDash, TokenWord, TokenTLess, TokenWord, TokenNewline, TokenEOF,
+		}, []string{"cat", "<<", "EOF", "<<-", "'X'", "<<<", "w", "\n", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			tokens := Lex(tt.input)
+			var kinds []TokenKind
+			var texts []string
+			for _, tok := range tokens {
+				kinds = append(kinds, tok.Kind)
+				texts = append(texts, tok.Text)
+			}
+			if !reflect.DeepEqual(kinds, tt.kinds) {
+				t.Errorf("kinds: got %v, want %v", kinds, tt.kinds)
+			}
+			if tt.texts != nil && !reflect.DeepEqual(texts, tt.texts) {
+				t.Errorf("texts: got %q, want %q", texts, tt.texts)
+			}
+		})
+	}
+}
+
+func TestLexWordProvenance(t *testing.T) {
+	tokens := Lex(`plain "dq \" x" 'sq' 2>err`)
+
+	want := []Token{
+		{Kind: TokenWord, Text: "plain", Value: "plain", Fd: -1, Pos: 0},
+		{Kind: TokenWord, Text: `"dq \" x"`, Value: `dq " x`, Quoted: true, Fd: -1, Pos: 6},
+		{Kind: TokenWord, Text: "'sq'", Value: "sq", Quoted: true, Fd: -1, Pos: 16},
+		{Kind: TokenGreat, Text: "2>", Fd: 2, Pos: 21},
+		{Kind: TokenWord, Text: "err", Value: "err", Fd: -1, Pos: 23},
+		{Kind: TokenEOF, Fd: -1, Pos: 26},
+	}
+	if !reflect.DeepEqual(tokens, want) {
+		t.Errorf("got  %+v\nwant %+v", tokens, want)
+	}
+}
+
+func TestQuotedOperators(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"echo 'a|b'", "a|b\n"},
+		{`echo "x > y"`, "x > y\n"},
+		{`echo a\|b \>c`, "a|b >c\n"},
+		{"echo '&&' ';'", "&& ;\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, errOut := executeCapture(executor, tt.command)
+			if errOut != "" || got != tt.want {
+				t.Errorf("got %q (stderr %q), want %q", got, errOut, tt.want)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	list, err := Parse("make && ./run || echo failed; ls | wc -l &\necho done")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(list.Items) != 3 {
+		t.Fatalf("items: got %d, want 3", len(list.Items))
+	}
+
+	first := list.Items[0].AndOr
+	if len(first.Pipelines) != 3 || !reflect.DeepEqual(first.Ops, []TokenKind{TokenAndIf, TokenOrIf}) {
+		t.Errorf("and-or: got %d pipelines, ops %v", len(first.Pipelines), first.Ops)
+	}
+
+	second := list.Items[1]
+	if !second.Background || len(second.AndOr.Pipelines[0].Commands) != 2 {
+		t.Errorf("pipeline: background %v, %d commands", second.Background, len(second.AndOr.Pipelines[0].Commands))
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"| grep x", "syntax error near unexpected token `|'"},
+		{"ls >", "syntax error near unexpected token `newline'"},
+		{"a && && b", "syntax error near unexpected token `&&'"},
+		{"a ;; b", "syntax error near unexpected token `;;'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse(tt.input)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorPositions(t *testing.T) {
+	tests := []struct {
+		input      string
+		line       int
+		column     int
+		token      string
+		incomplete bool
+	}{
+		{"| grep x", 1, 1, "|", false},
+		{"echo a | | b", 1, 10, "|", false},
+		{"ls >", 1, 5, "newline", false},
+		{"echo ok\nls > ; x", 2, 6, ";", false},
+		{"echo \"héllo\" ;;", 1, 14, ";;", false},
+		{"echo \"unterminated", 1, 6, "", true},
+		{"echo a\necho 'b", 2, 6, "", true},
+		{"echo a &&", 1, 10, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse(tt.input)
+			serr, ok := err.(*SyntaxError)
+			if !ok {
+				t.Fatalf("got %v, want a syntax error", err)
+			}
+			if serr.Line != tt.line || serr.Column != tt.column || serr.Token != tt.token || serr.Incomplete != tt.incomplete {
+				t.Errorf("got line %d column %d token %q incomplete %v", serr.Line, serr.Column, serr.Token, serr.Incomplete)
+			}
+		})
+	}
+}
+
+func TestSyntaxErrorOutput(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		stderr  string
+	}{
+		{"echo a | | b", "syntax error near unexpected token `|'\necho a | | b\n         ^\n"},
+		{"echo a\n\tls >", "syntax error near unexpected token `newline'\n\tls >\n\t    ^\n"},
+		{"echo \"unterminated", "unexpected EOF while looking for matching `\"'\necho \"unterminated\n     ^\n"},
+		{"echo a ||", "syntax error: unexpected end of file\necho a ||\n         ^\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, stderr := executeCapture(executor, tt.command)
+			if got != "" || stderr != tt.stderr {
+				t.Errorf("got %q, stderr %q, want stderr %q", got, stderr, tt.stderr)
+			}
+			if status, _ := executeCapture(executor, "echo $?"); status != "2\n" {
+				t.Errorf("status: got %q, want %q", status, "2\n")
+			}
+		})
+	}
+}
+
+func TestAndOrLists(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"echo a; echo b", "a\nb\n"},
+		{"echo a && echo b", "a\nb\n"},
+		{"echo a || echo b", "a\n"},
+		{"cd /nonexistent && echo b", ""},
+		{"cd /nonexistent || echo b", "b\n"},
+		{"cd /nonexistent && echo b || echo c", "c\n"},
+		{"echo a || echo b && echo c", "a\nc\n"},
+		{"echo a\necho b", "a\nb\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	script := dir + "/script.sh"
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexit 3\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		status  int
+	}{
+		{"echo hi", 0},
+		{"cd /nonexistent", 1},
+		{"nonexistent_command", 127},
+		{dir, 126},
+		{script, 126},
+		{"sh -c 'exit 42'", 42},
+		{"sh -c 'exit 42' | sh -c 'exit 5'", 5},
+		{"sh -c 'exit 3' || sh -c 'exit 4'", 4},
+		{"sh -c 'exit 3' && echo skipped", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			executor := newTestExecutor()
+			executeCapture(executor, tt.command)
+			if got := executor.state.LastStatus; got != tt.status {
+				t.Errorf("status: got %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
+
+func TestLastStatusParameter(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"sh -c 'exit 7'; echo $?", "7\n"},
+		{"echo $?", "0\n"},
+		{"nonexistent_command; echo \"status $?\"", "status 127\n"},
+		{"echo '$?' \\$?", "$? $?\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExternalStreams(t *testing.T) {
+	executor := newTestExecutor()
+
+	var out bytes.Buffer
+	executor.Stdin = strings.NewReader("from stdin\n")
+	executor.Stdout = &out
+
+	if status := executor.Execute("cat"); status != 0 {
+		t.Fatalf("cat: status %d", status)
+	}
+	if out.String() != "from stdin\n" {
+		t.Errorf("cat: wrote %q, want %q", out.String(), "from stdin\n")
+	}
+}
+
+func TestExternalStderr(t *testing.T) {
+	executor := newTestExecutor()
+
+	t.Run("separate streams", func(t *testing.T) {
+		var out, errOut bytes.Buffer
+		executor.Stdout = &out
+		executor.Stderr = &errOut
+
+		if status := executor.Execute("sh -c 'echo out; echo warning >&2'"); status != 0 {
+			t.Fatalf("status %d", status)
+		}
+		if out.String() != "out\n" || errOut.String() != "warning\n" {
+			t.Errorf("got stdout %q, stderr %q", out.String(), errOut.String())
+		}
+	})
+
+	t.Run("shared writer keeps order", func(t *testing.T) {
+		var out bytes.Buffer
+		executor.Stdout = &out
+		executor.Stderr = &out
+
+		executor.Execute("sh -c 'echo 1; echo 2 >&2; echo 3; echo 4 >&2'")
+		if out.String() != "1\n2\n3\n4\n" {
+			t.Errorf("got %q", out.String())
+		}
+	})
+
+	t.Run("failing command", func(t *testing.T) {
+		var errOut bytes.Buffer
+		executor.Stdout = &bytes.Buffer{}
+		executor.Stderr = &errOut
+
+		status := executor.Execute("sh -c 'echo broken >&2; exit 2'")
+		if errOut.String() != "broken\n" || status != 2 {
+			t.Errorf("got stderr %q, status %d", errOut.String(), status)
+		}
+	})
+}
+
+func TestByteExactOutput(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"printf foo", "foo"},
+		{"printf 'a\\n\\n'", "a\n\n"},
+		{"printf foo; echo bar", "foobar\n"},
+		{"echo a; printf b; echo c", "a\nbc\n"},
+		{"printf 'x\\ny' | cat", "x\ny"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedirections(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/in", []byte("input\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		stdout  string
+		files   map[string]string
+	}{
+		{"stdin", "cat <DIR/in", "input\n", nil},
+		{"several in any position", "cat >DIR/out 2>DIR/err <DIR/in", "", map[string]string{"out": "input\n", "err": ""}},
+		{"stderr to stdout", "sh -c 'echo e >&2' 2>&1", "e\n", nil},
+		{"stdout to stderr", "sh -c 'echo o' >&2", "", nil},
+		{"swap streams", "sh -c 'echo e >&2' 3>&1 1>&2 2>&3", "e\n", nil},
+		{"left to right", "sh -c 'echo o; echo e >&2' >DIR/out 2>&1", "", map[string]string{"out": "o\ne\n"}},
+		{"order matters", "sh -c 'echo e >&2' 2>&1 >DIR/out", "e\n", map[string]string{"out": ""}},
+		{"both streams", "sh -c 'echo o; echo e >&2' &>DIR/out", "", map[string]string{"out": "o\ne\n"}},
+		{"both streams append", "sh -c 'echo a' &>>DIR/out", "", map[string]string{"out": "o\ne\na\n"}},
+		{"clobber", "sh -c 'echo x' >|DIR/out", "", map[string]string{"out": "x\n"}},
+		{"read write", "cat <>DIR/in", "input\n", nil},
+		{"extra fd", "sh -c 'echo three >&3' 3>DIR/three", "", map[string]string{"three": "three\n"}},
+		{"dup input fd", "sh -c 'cat <&4' 4<DIR/in", "input\n", nil},
+		{"close fd", "sh -c 'echo gone' >&-", "", nil},
+	}
+
+	executor := newTestExecutor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := executeCapture(executor, strings.ReplaceAll(tt.command, "DIR", dir))
+			if got != tt.stdout {
+				t.Errorf("stdout: got %q, want %q", got, tt.stdout)
+			}
+			for name, want := range tt.files {
+				data, _ := os.ReadFile(dir + "/" + name)
+				if string(data) != want {
+					t.Errorf("%s: got %q, want %q", name, data, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedirectionErrors(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		stderr  string
+	}{
+		{"cat </nonexistent/file", "/nonexistent/file: No such file or directory\n"},
+		{"cat <&7", "7: Bad file descriptor\n"},
+		{"echo a 1>&-", "echo: write error: Bad file descriptor\n"},
+		{"{ pwd; } >&-", "pwd: write error: Bad file descriptor\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			_, got := executeCapture(executor, tt.command)
+			if got != tt.stderr || executor.state.LastStatus != 1 {
+				t.Errorf("got %q (status %d), want %q", got, executor.state.LastStatus, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestBuiltinRedirections(t *testing.T) {
+	dir := t.TempDir()
+	hist := &History{Items: []string{"echo one", "ls"}, MaxLen: 100}
+	state := NewShellState()
+	pathFinder := NewPathFinder()
+	executor := NewExecutor(pathFinder, NewBuiltinCommands(pathFinder, hist, state), state)
+
+	tests := []struct {
+		name    string
+		command string
+		file    string
+		want    string
+	}{
+		{"echo", "echo hi > DIR/f", "f", "hi\n"},
+		{"append", "echo again >> DIR/f", "f", "hi\nagain\n"},
+		{"type", "type type >DIR/type", "type", "type is a shell builtin\n"},
+		{"pwd", "pwd 1>DIR/pwd", "pwd", ""},
+		{"history", "history >DIR/hist", "hist", "0  echo one\n1  ls\n"},
+		{"stderr", "cd /nonexistent 2>DIR/err", "err", "cd: /nonexistent: No such file or directory\n"},
+		{"both", "cd /nonexistent &>DIR/both", "both", "cd: /nonexistent: No such file or directory\n"},
+		{"stdout to stderr", "echo warn >&2 2>DIR/ignored", "ignored", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := executeCapture(executor, strings.ReplaceAll(tt.command, "DIR", dir))
+			if got != "" {
+				t.Errorf("stdout: got %q, want nothing", got)
+			}
+			data, err := os.ReadFile(dir + "/" + tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.name == "pwd" {
+				cwd, _ := os.Getwd()
+				tt.want = cwd + "\n"
+			}
+			if string(data) != tt.want {
+				t.Errorf("%s: got %q, want %q", tt.file, data, tt.want)
+			}
+		})
+	}
+
+	t.Run("echo to stderr", func(t *testing.T) {
+		got, errOut := executeCapture(executor, "echo warn >&2")
+		if got != "" || errOut != "warn\n" {
+			t.Errorf("got stdout %q, stderr %q", got, errOut)
+		}
+	})
+}
+
+func TestHistoryFile(t *testing.T) {
+	file := t.TempDir() + "/hist"
+
+	// a file written by another shell: backslashes are taken literally
+	// and the entries are written back byte for byte
+	plain := "printf \"a\\nb\"\necho C:\\\\new\n#+x\n"
+	if err := os.WriteFile(file, []byte(plain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	hist := &History{File: file, MaxLen: 100}
+	if err := hist.ReadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`printf "a\nb"`, `echo C:\\new`, "#+x"}
+	if !reflect.DeepEqual(hist.Items, want) {
+		t.Errorf("read: got %q, want %q", hist.Items, want)
+	}
+	os.Remove(file)
+	if err := hist.AppendToFile(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != plain {
+		t.Errorf("write: got %q, want %q", data, plain)
+	}
+
+	// commands spanning several lines come back as one entry each
+	items := []string{"echo 'a\nb'", `printf 'x\n' \\`, "for i in 1; do\necho $i\ndone", "#+2", "last"}
+	hist.Items = slices.Clone(items)
+	os.Remove(file)
+	if err := hist.AppendToFile(); err != nil {
+		t.Fatal(err)
+	}
+	if err := hist.ReadFromFile(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hist.Items, items) {
+		t.Errorf("round trip: got %q, want %q", hist.Items, items)
+	}
+}
+
+func TestPipelineRedirections(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/in", []byte("b\nx1\na\nx2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		stdout  string
+		file    string
+		want    string
+	}{
+		{"stderr into pipe", "sh -c 'echo out; echo err >&2' 2>&1 | sort", "err\nout\n", "", ""},
+		{"input and output", "grep x < DIR/in | sort -r > DIR/out", "", "out", "x2\nx1\n"},
+		{"redirect overrides pipe", "sh -c 'echo lost' > DIR/lost | cat", "", "lost", "lost\n"},
+		{"tee", "sh -c 'echo build; echo warn >&2' 2>&1 | tee DIR/log | wc -l", "2\n", "log", "build\nwarn\n"},
+	}
+
+	executor := newTestExecutor()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := executeCapture(executor, strings.ReplaceAll(tt.command, "DIR", dir))
+			if strings.TrimLeft(got, " ") != tt.stdout {
+				t.Errorf("stdout: got %q, want %q", got, tt.stdout)
+			}
+			if tt.file == "" {
+				return
+			}
+			data, _ := os.ReadFile(dir + "/" + tt.file)
+			if string(data) != tt.want {
+				t.Errorf("%s: got %q, want %q", tt.file, data, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuiltinsInPipelines(t *testing.T) {
+	hist := &History{Items: []string{"echo foo", "ls", "cat foo.txt"}, MaxLen: 100}
+	state := NewShellState()
+	pathFinder := NewPathFinder()
+	executor := NewExecutor(pathFinder, NewBuiltinCommands(pathFinder, hist, state), state)
+
+	tests := []struct {
+		command string
+		stdout  string
+		stderr  string
+		status  int
+	}{
+		{"history | grep foo", "0  echo foo\n2  cat foo.txt\n", "", 0},
+		{"echo x | cat | type", "", "", 0},
+		{"echo hello | cat | cat", "hello\n", "", 0},
+		{"echo one | tr a-z A-Z", "ONE\n", "", 0},
+		{"type echo | cat", "echo is a shell builtin\n", "", 0},
+		{"cd /nonexistent | cat", "", "cd: /nonexistent: No such file or directory\n", 0},
+		{"echo a | cd /nonexistent", "", "cd: /nonexistent: No such file or directory\n", 1},
+		{"seq 1 100000 | echo done", "done\n", "", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			// run repeatedly to catch output racing the next command
+			for i := 0; i < 20; i++ {
+				stdout, stderr := executeCapture(executor, tt.command)
+				if stdout != tt.stdout || stderr != tt.stderr || state.LastStatus != tt.status {
+					t.Fatalf("run %d: got stdout %q, stderr %q, status %d", i, stdout, stderr, state.LastStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestPipelineSubshells(t *testing.T) {
+	executor := newTestExecutor()
+	cwd, _ := os.Getwd()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"exit 4 | cat; echo alive $?", "alive 0\n"},
+		{"cat </dev/null | exit 4; echo alive $?", "alive 4\n"},
+		{"cd / | cat; pwd", cwd + "\n"},
+		{"echo a | { cd /; pwd; }; pwd", "/\n" + cwd + "\n"},
+		{"unset x; x=1 | cat; echo \"[$x]\"", "[]\n"},
+		{"echo a | read x; echo \"[$x]\"", "[]\n"},
+		{"echo a | { read x; echo \"[$x]\"; }", "[a]\n"},
+		{"set -o pipefail | shopt -s dotglob; shopt -q dotglob || echo off", "off\n"},
+		{"(( 1 )) | false | true; echo ${PIPESTATUS[@]}", "0 1 0\n"},
+		{"{ false | true; } | cat; echo ${PIPESTATUS[@]}", "0 0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, errOut := executeCapture(executor, tt.command)
+			if errOut != "" || got != tt.want {
+				t.Errorf("got %q (stderr %q), want %q", got, errOut, tt.want)
+			}
+		})
+	}
+}
+
+func TestPipeStatus(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"sh -c 'exit 3' | sh -c 'exit 0'; echo $? ${PIPESTATUS[@]}", "0 3 0\n"},
+		{"true | false | true; echo ${PIPESTATUS[1]} $PIPESTATUS", "1 0\n"},
+		{"sh -c 'exit 2'; echo ${PIPESTATUS[*]}", "2\n"},
+		{"set -o pipefail; sh -c 'exit 3' | sh -c 'exit 4' | true; echo $?", "4\n"},
+		{"set -o pipefail; true | true; echo $?", "0\n"},
+		{"set -o pipefail; set +o pipefail; false | true; echo $?", "0\n"},
+		{"set -o pipefail; false | true && echo ok || echo failed", "failed\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(newTestExecutor(), tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackgroundJobs(t *testing.T) {
+	executor := newTestExecutor()
+
+	// the jobs finish after the foreground pipeline and must not change
+	// its statuses, nor end the shell with exit
+	executor.Stdout, executor.Stderr = io.Discard, io.Discard
+	executor.Execute("{ sleep 0.05; false | false; } & exit 3 & x=1 & true | true")
+	time.Sleep(200 * time.Millisecond)
+
+	got, _ := executeCapture(executor, "echo $? ${PIPESTATUS[@]} [$x]")
+	if got != "0 0 0 []\n" {
+		t.Errorf("got %q, want %q", got, "0 0 0 []\n")
+	}
+
+	// a job keeps writing to the files of the command around it after
+	// that command has closed them
+	dir := t.TempDir()
+	got, _ = executeCapture(executor, strings.ReplaceAll("{ sleep 0.1 && echo inner & } >DIR/f 2>DIR/err; sleep 0.4; cat DIR/f DIR/err", "DIR", dir))
+	if got != "inner\n" {
+		t.Errorf("redirected job: got %q", got)
+	}
+}
+
+func TestForegroundSignals(t *testing.T) {
+	catchSignals()
+	defer signal.Reset(os.Interrupt, syscall.SIGQUIT)
+	executor := newTestExecutor()
+
+	// the terminal sends Ctrl+C and Ctrl+\ to the shell as well as to
+	// the program it runs, and the shell must survive them
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		syscall.Kill(os.Getpid(), syscall.SIGQUIT)
+	}()
+
+	got, _ := executeCapture(executor, "sleep 0.3; echo survived")
+	if got != "survived\n" {
+		t.Errorf("got %q, want %q", got, "survived\n")
+	}
+
+	// a program killed by Ctrl+C stops the rest of the command line,
+	// loops included, but not the next one
+	tests := []string{
+		"while true; do sh -c 'kill -INT $$'; echo looped; done; echo after",
+		"for i in 1 2; do echo | sh -c 'kill -INT $$'; echo looped; done",
+		"until false; do x=$(sh -c 'kill -INT $$'); echo looped; done",
+		"sh -c 'kill -INT $$' && echo and || echo or",
+	}
+	for _, command := range tests {
+		t.Run(command, func(t *testing.T) {
+			got, _ := executeCapture(executor, command+"\necho next $?")
+			if got != "" {
+				t.Errorf("got %q, want nothing", got)
+			}
+			got, _ = executeCapture(executor, "echo next $?")
+			if got != "next 130\n" {
+				t.Errorf("next command: got %q", got)
+			}
+		})
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	executor := newTestExecutor()
+
+	got, _ := executeCapture(executor, "set -o pipefail; set -o")
+	if got != "pipefail       \ton\n" {
+		t.Errorf("set -o: got %q", got)
+	}
+
+	_, errOut := executeCapture(executor, "set -o nosuchoption")
+	if errOut != "set: nosuchoption: invalid option name\n" || executor.state.LastStatus != 1 {
+		t.Errorf("invalid option: got %q (status %d)", errOut, executor.state.LastStatus)
+	}
+}
+
+func TestUnknownCommandInPipeline(t *testing.T) {
+	tests := []struct {
+		command string
+		stdout  string
+		stderr  string
+		status  string
+	}{
+		{"nosuchcmd | cat", "", "nosuchcmd: command not found\n", "127 0"},
+		{"echo hi | nosuchcmd", "", "nosuchcmd: command not found\n", "0 127"},
+		{"echo hi | nosuchcmd | cat", "", "nosuchcmd: command not found\n", "0 127 0"},
+		{"yes | nosuchcmd", "", "nosuchcmd: command not found\n", "141 127"},
+		{"./nosuchfile | wc -c", "0\n", "./nosuchfile: No such file or directory\n", "127 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			executor := newTestExecutor()
+
+			done := make(chan struct{})
+			var stdout, stderr string
+			go func() {
+				stdout, stderr = executeCapture(executor, tt.command)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("pipeline did not finish")
+			}
+
+			if strings.TrimLeft(stdout, " ") != tt.stdout || stderr != tt.stderr {
+				t.Errorf("got stdout %q, stderr %q", stdout, stderr)
+			}
+			statuses, _ := executeCapture(executor, "echo ${PIPESTATUS[@]}")
+			if statuses != tt.status+"\n" {
+				t.Errorf("PIPESTATUS: got %q, want %q", statuses, tt.status)
+			}
+		})
+	}
+}
+
+func TestVariables(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"x=1; echo $x ${x}", "1 1\n"},
+		{"x=1 y=2; echo $x$y ${x}b $xb", "12 1b\n"},
+		{"x=1; echo '$x' \"$x\" \\$x", "$x 1 $x\n"},
+		{"x='a  b'; echo $x; echo \"$x\"", "a b\na  b\n"},
+		{"x='a  b'; sh -c 'echo $#' - $x \"$x\"", "3\n"},
+		{"sh -c 'echo $#' - $nosuch \"$nosuch\" ''", "2\n"},
+		{"x=' a '; echo [$x]", "[ a ]\n"},
+		{"x=a; x=$x$x; echo $x", "aa\n"},
+		{"x=1; x=$((x+1)) y=$x; echo $x $y", "2 2\n"},
+		{"echo $ a$", "$ a$\n"},
+		{"FOO=bar sh -c 'echo $FOO'; echo \"[$FOO]\"", "bar\n[]\n"},
+		{"x=out; echo hi >/dev/null; echo ${PIPESTATUS[0]} ${PIPESTATUS[@]}", "0 0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("environment", func(t *testing.T) {
+		t.Setenv("SHELL_TEST_VAR", "from env")
+		got, _ := executeCapture(newTestExecutor(), "echo \"$SHELL_TEST_VAR\"")
+		if got != "from env\n" {
+			t.Errorf("got %q, want %q", got, "from env\n")
+		}
+	})
+
+	t.Run("bad substitution", func(t *testing.T) {
+		got, stderr := executeCapture(executor, "echo ${x!}")
+		if got != "" || stderr != "${x!}: bad substitution\n" {
+			t.Errorf("got %q, stderr %q", got, stderr)
+		}
+		got, _ = executeCapture(executor, "echo $?")
+		if got != "1\n" {
+			t.Errorf("status: got %q, want %q", got, "1\n")
+		}
+	})
+}
+
+func TestParameterOperators(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"unset_var=; echo ${unset_var:-a} [${unset_var-b}] ${nosuch-c}", "a [] c\n"},
+		{"echo ${d1:=one} $d1; d2=; echo ${d2=two} [$d2]", "one one\n[]\n"},
+		{"x=1; echo [${x:+alt}] [${nosuch:+alt}]", "[alt] []\n"},
+		{"x=hello.tar.gz; echo ${#x} ${x#*.} ${x##*.} ${x%.*} ${x%%.*}", "12 tar.gz gz hello.tar hello\n"},
+		{"x=abcabc; echo ${x/b/X} ${x//b/X} ${x/#a/X} ${x/%c/X} ${x//[ac]}", "aXcabc aXcaXc Xbcabc abcabX bb\n"},
+		{"x=abcdef; echo ${x:2} ${x:1:3} ${x: -2} ${x:1:-1} [${x:10}]", "cdef bcd ef bcde []\n"},
+		{"x=hello; X=WORLD; echo ${x^^} ${x^} ${X,,} ${X,} ${x^^[lo]}", "HELLO Hello world wORLD heLLO\n"},
+		{"x='a*b'; echo ${x#'a*'} ${x#a\\*} ${x#a*}", "b b *b\n"},
+		{"p='*.'; x=a.b.c; echo ${x#$p} ${x#\"$p\"}", "b.c a.b.c\n"},
+		{"x='a  b'; echo \"${nosuch:-$x}\" ${nosuch:-$x}", "a  b a b\n"},
+		{"echo ${#PIPESTATUS[@]}", "1\n"},
+		{"printf '<%s>' ${b:-'q r'} ${b:-\"q  r\"} ${b:-q\\ r}", "<q r><q  r><q r>"},
+		{"printf '<%s>' ${b:-a b} ${b:-'*'} ${b:=\"c  d\"} \"$b\"", "<a><b><*><c  d><c  d>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	errorTests := []struct {
+		command string
+		stderr  string
+	}{
+		{"echo ${nosuch:?}", "nosuch: parameter null or not set\n"},
+		{"echo ${nosuch?must be set}", "nosuch: must be set\n"},
+		{"echo ${1:=x}", "${1:=x}: cannot assign in this way\n"},
+		{"x=abc; echo ${x:2:-2}", "-2: substring expression < 0\n"},
+		{"echo ${x!}", "${x!}: bad substitution\n"},
+	}
+
+	for _, tt := range errorTests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, stderr := executeCapture(executor, tt.command)
+			if got != "" || stderr != tt.stderr {
+				t.Errorf("got %q, stderr %q, want stderr %q", got, stderr, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbb", false},
+		{"a?c", "abc", true},
+		{"a?c", "ac", false},
+		{"*.go", "main.go", true},
+		{"[abc]x", "bx", true},
+		{"[!abc]x", "bx", false},
+		{"[a-z]*", "hello", true},
+		{"[]]", "]", true},
+		{"[[:digit:]][[:alpha:]]", "1a", true},
+		{"[[:upper:]]", "a", false},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{"[ab", "[ab", true},
+		{"*a*b*c*", "xaybzc", true},
+		{"ü?", "üx", true},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"x=1; sh -c 'echo [$x]'; export x; sh -c 'echo [$x]'", "[]\n[1]\n"},
+		{"export x=1; export -n x; sh -c 'echo [$x]'; echo $x", "[]\n1\n"},
+		{"export x; sh -c 'echo ${x-unset}'; x=2; sh -c 'echo $x'", "unset\n2\n"},
+		{"FOO=bar sh -c 'echo $FOO'; echo [$FOO]", "bar\n[]\n"},
+		{"export FOO=a; FOO=b sh -c 'echo $FOO'; echo $FOO", "b\na\n"},
+		{"A=1 B=2 sh -c 'echo $A$B'", "12\n"},
+		{"x=1; unset x; echo [${x-unset}]", "[unset]\n"},
+		{"v='a  b'; export W=$v; sh -c 'echo \"$W\"'", "a  b\n"},
+		{"x='say \"hi\" $y'; declare -p x", "declare -- x=\"say \\\"hi\\\" \\$y\"\n"},
+		{"export x=1; readonly x; declare -p x", "declare -rx x=\"1\"\n"},
+		{"declare -x d=1; declare +x d; declare -p d", "declare -- d=\"1\"\n"},
+		{"export e1=1 e2; export -p | grep ' e[12]'", "declare -x e1=\"1\"\ndeclare -x e2\n"},
+		{"readonly r=1; readonly | grep ' r='", "declare -r r=\"1\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, stderr := executeCapture(newTestExecutor(), tt.command)
+			if got != tt.want || stderr != "" {
+				t.Errorf("got %q, stderr %q, want %q", got, stderr, tt.want)
+			}
+		})
+	}
+
+	errorTests := []struct {
+		command string
+		want    string
+		stderr  string
+	}{
+		{"readonly r=1; r=2; echo $? $r", "1 1\n", "r: readonly variable\n"},
+		{"readonly r=1; unset r; echo $?", "1\n", "unset: r: cannot unset: readonly variable\n"},
+		{"export ok=1 1bad; echo $? $ok", "1 1\n", "export: `1bad': not a valid identifier\n"},
+		{"declare -p nosuch", "", "declare: nosuch: not found\n"},
+		{"export -z", "", "export: -z: invalid option\n"},
+	}
+
+	for _, tt := range errorTests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, stderr := executeCapture(newTestExecutor(), tt.command)
+			if got != tt.want || stderr != tt.stderr {
+				t.Errorf("got %q, stderr %q, want %q, %q", got, stderr, tt.want, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestPathUpdates(t *testing.T) {
+	dir := t.TempDir()
+	script := dir + "/hello_from_path"
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho hello\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	executor := newTestExecutor()
+	got, _ := executeCapture(executor, "PATH=\""+dir+":$PATH\"; hello_from_path; type hello_from_path")
+	if want := "hello\nhello_from_path is " + script + "\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	got, stderr := executeCapture(executor, "unset PATH; hello_from_path; echo $?")
+	if got != "127\n" || stderr != "hello_from_path: command not found\n" {
+		t.Errorf("after unset: got %q, stderr %q", got, stderr)
+	}
+
+	// a PATH assignment before the command is used to find it, but only
+	// for that command
+	got, stderr = executeCapture(executor, "PATH="+dir+" hello_from_path; hello_from_path")
+	if got != "hello\n" || stderr != "hello_from_path: command not found\n" {
+		t.Errorf("prefix assignment: got %q, stderr %q", got, stderr)
+	}
+}
+
+func TestCommandSubstitution(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"echo $(echo hi) `echo there`", "hi there\n"},
+		{"echo \"$(printf 'a\\n\\n\\n')\"x", "ax\n"},
+		{"sh -c 'echo $#' - $(printf 'a  b\\nc') \"$(printf 'a  b')\"", "4\n"},
+		{"echo $(echo $(echo deep) \"$(echo q)\")", "deep q\n"},
+		{"echo `echo \\`echo nested\\``", "nested\n"},
+		{"echo $(echo 'a)b' \")\")", "a)b )\n"},
+		{"x=$(echo val); echo $x", "val\n"},
+		{"x=$(false); echo $?; x=$(true); echo $?", "1\n0\n"},
+		{"echo $(sh -c 'exit 3') $?", "3\n"},
+		{"echo '$(echo no)' \"\\$(echo no)\"", "$(echo no) $(echo no)\n"},
+		{"echo $(echo a | tr a b)", "b\n"},
+		{"echo $(echo out; echo err >&2) 2>/dev/null", "out\n"},
+		{"echo $(exit 3); echo alive $?", "\nalive 0\n"},
+		{"x=$(exit 4); echo $?", "4\n"},
+		{"x=$(echo a; exit 5; echo b); echo $x $?", "a 5\n"},
+		{"x=$(for i in 1 2; do exit 6; done; echo no); echo $?", "6\n"},
+		{"unset y; v=$(y=5; echo $y); echo $v \"[$y]\"", "5 []\n"},
+		{"v=$(shopt -s dotglob); shopt -q dotglob || echo unchanged", "unchanged\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("working directory", func(t *testing.T) {
+		dir := t.TempDir()
+		if err := os.WriteFile(dir+"/file", []byte("in dir\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cwd, _ := os.Getwd()
+
+		got, _ := executeCapture(executor, "echo $(cd "+dir+"; pwd; cat file; echo *; echo x >out; ls $PWD/out)")
+		want := dir + " in dir file " + dir + "/out\n"
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		if now, _ := os.Getwd(); now != cwd {
+			t.Errorf("working directory changed to %q", now)
+		}
+	})
+
+	t.Run("stderr is not captured", func(t *testing.T) {
+		got, stderr := executeCapture(executor, "x=$(echo err >&2)")
+		if got != "" || stderr != "err\n" {
+			t.Errorf("got %q, stderr %q", got, stderr)
+		}
+	})
+
+	t.Run("descriptors of the command", func(t *testing.T) {
+		tests := []struct {
+			command string
+			want    string
+			stderr  string
+		}{
+			{"{ x=$(cat); echo \"got:$x\"; } <<< hi", "got:hi\n", ""},
+			{"{ echo $(echo err >&2) x; } 2>/dev/null", "x\n", ""},
+			{"echo hi | { x=$(cat); echo \"got:$x\"; }", "got:hi\n", ""},
+			{"echo a | echo $(cat) $(echo err >&2) 2>/dev/null", "a\n", "err\n"},
+			{"for w in $(cat); do echo $w; done <<< 'in loop'", "in\nloop\n", ""},
+		}
+		for _, tt := range tests {
+			got, stderr := executeCapture(executor, tt.command)
+			if got != tt.want || stderr != tt.stderr {
+				t.Errorf("%s: got %q, stderr %q, want %q, %q", tt.command, got, stderr, tt.want, tt.stderr)
+			}
+		}
+	})
+
+	t.Run("unterminated", func(t *testing.T) {
+		_, stderr := executeCapture(executor, "echo $(echo")
+		if stderr != "unexpected EOF while looking for matching `)'\necho $(echo\n     ^\n" {
+			t.Errorf("stderr %q", stderr)
+		}
+	})
+}
+
+func TestEvalArith(t *testing.T) {
+	vars := NewVariables()
+	vars.Unset("nosuch")
+	vars.Set("x", "5")
+	vars.Set("expr", "x*2")
+
+	tests := []struct {
+		expr string
+		want int64
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"2 ** 3 ** 2", 512},
+		{"-2 ** 2", 4},
+		{"3 ** 5 + 2 ** 62", 243 + 1<<62},
+		{"2 ** 64", 0},
+		{"-1 ** 9223372036854775807", -1},
+		{"7 / 2 + 7 % 3", 4},
+		{"1 << 4 | 1", 17},
+		{"6 & 3 ^ 1", 3},
+		{"!0 + !5 + ~0", 0},
+		{"3 > 2 && 2 >= 2 && 1 != 2 && 1 == 1", 1},
+		{"0 || 0", 0},
+		{"x ? 10 : 20", 10},
+		{"0 ? 1 : 0 ? 2 : 3", 3},
+		{"0x1F + 010 + 2#11 + 36#z", 31 + 8 + 3 + 35},
+		{"expr + 1", 11},
+		{"nosuch + 1", 1},
+		{"x += 2, x", 7},
+		{"x++ + x", 15},
+		{"--x", 7},
+		{"y = x = 1", 1},
+		{"0 && (x = 100)", 0},
+		{"", 0},
+	}
+
+	for _, tt := range tests {
+		got, err := evalArith(tt.expr, vars)
+		if err != nil || got != tt.want {
+			t.Errorf("evalArith(%q) = %d, %v, want %d", tt.expr, got, err, tt.want)
+		}
+	}
+	if v, _ := vars.Get("x"); v != "1" {
+		t.Errorf("x = %q, want %q", v, "1")
+	}
+
+	errorTests := []struct {
+		expr string
+		want string
+	}{
+		{"1 / 0", "1 / 0: division by 0"},
+		{"2 ** -1", "2 ** -1: exponent less than 0"},
+		{"1 +", `1 +: syntax error: operand expected (error token is "")`},
+		{"(1", "(1: missing `)' (error token is \"\")"},
+		{"1 2", `1 2: syntax error in expression (error token is "2")`},
+		{"1 ? 2", "1 ? 2: syntax error: `:' expected for conditional expression (error token is \"\")"},
+		{"08", `08: value too great for base (error token is "08")`},
+		{"1 $ 2", `1 $ 2: syntax error: invalid arithmetic operator (error token is "$ 2")`},
+	}
+
+	for _, tt := range errorTests {
+		_, err := evalArith(tt.expr, vars)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("evalArith(%q) error = %v, want %q", tt.expr, err, tt.want)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"echo $((1 + 2)) $(( (1+2) * 3 ))", "3 9\n"},
+		{"x=5; echo $((x + 1)) $(($x * 2)) \"$((x - 1))\"", "6 10 4\n"},
+		{"i=0; ((i++)); echo $? $i; ((i--)); echo $? $i", "1 1\n0 0\n"},
+		{"((5 > 3)) && echo yes; ((0)) || echo no", "yes\nno\n"},
+		{"((a = 2, b = a * 3)); echo $a $b", "2 6\n"},
+		{"echo $(( $(echo 4) * 2 ))", "8\n"},
+		{"s=abcdef; n=1; echo ${s:n+1:2*n}", "cd\n"},
+		{"echo $((1 / 0)); echo $?", "1\n"},
+		{"((1)) >/dev/null; echo $?", "0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGlobbing(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "b.go", "c.txt", ".hidden", "sub/x.go", "sub/deep/y.go", "sp ace/z.go"} {
+		path := dir + "/" + name
+		if err := os.MkdirAll(path[:strings.LastIndex(path, "/")], 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Chdir(dir)
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"echo *.go", "a.go b.go\n"},
+		{"echo ?.* [ab].go [!a]*.go", "a.go b.go c.txt a.go b.go b.go\n"},
+		{"echo \"*.go\" '*'.go \\*.go", "*.go *.go *.go\n"},
+		{"echo *.none", "*.none\n"},
+		{"echo *", "a.go b.go c.txt sp ace sub\n"},
+		{"echo */ s?b/*.go", "sp ace/ sub/ sub/x.go\n"},
+		{"echo */*.go", "sp ace/z.go sub/x.go\n"},
+		{"sh -c 'echo $#' - sp*/*", "1\n"},
+		{"p='*.txt'; echo $p \"$p\"", "c.txt *.txt\n"},
+		{"echo " + dir + "/*.txt", dir + "/c.txt\n"},
+		{"x=*.go; echo \"$x\"", "*.go\n"},
+		{"echo *.go >out*; cat 'out*'", "a.go b.go\n"},
+		{"shopt -s dotglob; echo .h* *.txt; shopt -u dotglob", ".hidden c.txt\n"},
+		{"shopt -s nullglob; echo [*.none] none*; shopt -u nullglob", "\n"},
+		{"shopt -s globstar; echo **/*.go; shopt -u globstar", "a.go b.go sp ace/z.go sub/deep/y.go sub/x.go\n"},
+		{"shopt -s globstar; echo sub/**; shopt -u globstar", "sub/deep sub/deep/y.go sub/x.go\n"},
+		{"echo **/y.go", "**/y.go\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			executor := newTestExecutor()
+			got, stderr := executeCapture(executor, tt.command)
+			if got != tt.want || stderr != "" {
+				t.Errorf("got %q, stderr %q, want %q", got, stderr, tt.want)
+			}
+		})
+	}
+
+	t.Run("failglob", func(t *testing.T) {
+		got, stderr := executeCapture(newTestExecutor(), "shopt -s failglob; echo *.none; echo $?")
+		if got != "1\n" || stderr != "no match: *.none\n" {
+			t.Errorf("got %q, stderr %q", got, stderr)
+		}
+	})
+}
+
+func TestShopt(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"shopt nullglob", "nullglob       \toff\n"},
+		{"shopt -s nullglob globstar; shopt -p nullglob dotglob", "shopt -s nullglob\nshopt -u dotglob\n"},
+		{"shopt -s dotglob; shopt -s", "dotglob        \ton\n"},
+		{"shopt -q nullglob; echo $?; shopt -s nullglob; shopt -q nullglob; echo $?", "1\n0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, stderr := executeCapture(newTestExecutor(), tt.command)
+			if got != tt.want || stderr != "" {
+				t.Errorf("got %q, stderr %q, want %q", got, stderr, tt.want)
+			}
+		})
+	}
+
+	_, stderr := executeCapture(newTestExecutor(), "shopt -s bogus")
+	if stderr != "shopt: bogus: invalid shell option name\n" {
+		t.Errorf("stderr %q", stderr)
+	}
+}
+
+func TestBraceExpansion(t *testing.T) {
+	tests := []struct {
+		word string
+		want []string
+	}{
+		{"a{b,c}d", []string{"abd", "acd"}},
+		{"{a,b{1,2},c}x", []string{"ax", "b1x", "b2x", "cx"}},
+		{"{a,b}{1,2}", []string{"a1", "a2", "b1", "b2"}},
+		{"a{,b}", []string{"a", "ab"}},
+		{"{1..5}", []string{"1", "2", "3", "4", "5"}},
+		{"{3..1}", []string{"3", "2", "1"}},
+		{"{01..10..3}", []string{"01", "04", "07", "10"}},
+		{"{-2..2..2}", []string{"-2", "0", "2"}},
+		{"{a..e..2}", []string{"a", "c", "e"}},
+		{"{Z..X}", []string{"Z", "Y", "X"}},
+		{"{a}", []string{"{a}"}},
+		{"{}", []string{"{}"}},
+		{"{a..}", []string{"{a..}"}},
+		{"{1..a}", []string{"{1..a}"}},
+		{"{a,b", []string{"{a,b"}},
+		{"'{a,b}'", []string{"'{a,b}'"}},
+		{"\"{a,b}\"", []string{"\"{a,b}\""}},
+		{`\{a,b}`, []string{`\{a,b}`}},
+		{"${x:-{a,b}}", []string{"${x:-{a,b}}"}},
+		{"{'a,b',c}", []string{"'a,b'", "c"}},
+		{"{$x,y}", []string{"$x", "y"}},
+	}
+
+	for _, tt := range tests {
+		if got := expandBraces(tt.word); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("expandBraces(%q) = %q, want %q", tt.word, got, tt.want)
+		}
+	}
+
+	executor := newTestExecutor()
+	got, _ := executeCapture(executor, "x=1; echo pre{${x},\"a b\"}post {1..3}")
+	if want := "pre1post prea bpost 1 2 3\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTildeExpansion(t *testing.T) {
+	t.Chdir(t.TempDir())
+	cwd, _ := os.Getwd()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"HOME=/home/me; echo ~ ~/src ~/", "/home/me /home/me/src /home/me/\n"},
+		{"HOME=/home/me; echo \"~\" '~' \\~ a~ ~x/y", "~ ~ ~ a~ ~x/y\n"},
+		{"HOME=/home/me; x=~/a:~/b; echo $x", "/home/me/a:/home/me/b\n"},
+		{"HOME=/home/me; export P=/bin:~/bin; echo $P", "/bin:/home/me/bin\n"},
+		{"HOME=/home/me; echo a:~ ${nosuch:-~}", "a:~ /home/me\n"},
+		{"HOME='/a b'; sh -c 'echo $#' - ~", "1\n"},
+		{"echo ~+", cwd + "\n"},
+		{"echo ~-; cd /; echo ~- ~+; cd " + cwd, "~-\n" + cwd + " /\n"},
+		{"echo $((~0))", "-1\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			executor := newTestExecutor()
+			executor.state.Vars.Unset("OLDPWD")
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if u, err := user.Current(); err == nil {
+		got, _ := executeCapture(newTestExecutor(), "echo ~"+u.Username)
+		if got != u.HomeDir+"\n" {
+			t.Errorf("~%s: got %q, want %q", u.Username, got, u.HomeDir+"\n")
+		}
+	}
+
+	t.Run("redirection target", func(t *testing.T) {
+		_, stderr := executeCapture(newTestExecutor(), "HOME=/home/me; echo hi >~/nosuch/f")
+		if stderr != "/home/me/nosuch/f: No such file or directory\n" {
+			t.Errorf("stderr %q", stderr)
+		}
+	})
+}
+
+func TestCdHome(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir("/")
+
+	executor := newTestExecutor()
+	got, _ := executeCapture(executor, "HOME="+dir+"; cd; pwd; cd ~/; pwd; cd /; cd ~; pwd")
+	if want := dir + "\n" + dir + "\n" + dir + "\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	_, stderr := executeCapture(executor, "unset HOME; cd")
+	if stderr != "cd: HOME not set\n" {
+		t.Errorf("stderr %q", stderr)
+	}
+}
+
+func TestFieldSplitting(t *testing.T) {
+	// args prints each argument it receives on its own line
+	const args = "sh -c 'for a; do echo \"[$a]\"; done' -"
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"x='  a   b  '; " + args + " $x", "[a]\n[b]\n"},
+		{"x='a  b'; " + args + " \"$x\"", "[a  b]\n"},
+		{"x=' a b '; " + args + " pre${x}post", "[pre]\n[a]\n[b]\n[post]\n"},
+		{"IFS=:; x='a:b::c:'; " + args + " $x", "[a]\n[b]\n[]\n[c]\n"},
+		{"IFS=:; x=':a'; " + args + " $x", "[]\n[a]\n"},
+		{"IFS=' :'; x=' a : b  c :: d '; " + args + " $x", "[a]\n[b]\n[c]\n[]\n[d]\n"},
+		{"IFS=:; x='a b'; " + args + " $x", "[a b]\n"},
+		{"IFS=; x='a b:c'; " + args + " $x", "[a b:c]\n"},
+		{"IFS=,; " + args + " $(echo a,b) \"$(echo c,d)\"", "[a]\n[b]\n[c,d]\n"},
+		{"IFS=:; x=a:b; " + args + " $x:c", "[a]\n[b:c]\n"},
+		{"x=; " + args + " $x \"$x\" ''$x", "[]\n[]\n"},
+		{"IFS=:; x=:; " + args + " $x", "[]\n"},
+		{args + " $(printf 'one\\ntwo three\\n')", "[one]\n[two]\n[three]\n"},
+		{"unset IFS; x='a\tb'; " + args + " $x", "[a]\n[b]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, stderr := executeCapture(newTestExecutor(), tt.command)
+			if got != tt.want || stderr != "" {
+				t.Errorf("got %q, stderr %q, want %q", got, stderr, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeredocs(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"x=world\ncat <<EOF\nhello $x \"q\" 'q' \\$x `echo bt`\n$((1 + 2))\nEOF", "hello world \"q\" 'q' $x bt\n3\n"},
+		{"x=world\ncat <<'EOF'\nraw $x \\$x\nEOF", "raw $x \\$x\n"},
+		{"cat <<\"E F\"\n$x\nE F", "$x\n"},
+		{"cat <<E\\OF\n$x\nEOF", "$x\n"},
+		{"cat <<-END\n\t\tindented\n\tEND", "indented\n"},
+		{"cat <<END\n\tkept\nEND", "\tkept\n"},
+		{"cat <<EOF\nline \\\ncontinued\nEOF", "line continued\n"},
+		{"cat <<EOF\nEOF", ""},
+		{"cat <<A; cat <<B\na\nA\nb\nB\necho after", "a\nb\nafter\n"},
+		{"cat <<A <<B\na\nA\nb\nB", "b\n"},
+		{"cat <<EOF | tr a-z A-Z\npiped\nEOF", "PIPED\n"},
+		{"x=1; cat <<<\"here $x\"", "here 1\n"},
+		{"cat <<< 'a  b' | wc -c | tr -d ' '", "5\n"},
+		{"cat <<EOF\nunterminated $HOME_NOT_SET", "unterminated \n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, _ := executeCapture(executor, tt.command)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeredocBodies(t *testing.T) {
+	tokens := Lex("cat <<A <<-B\na\n\tb\nA\n\tb2\n\tB\necho")
+
+	var bodies []string
+	for _, tok := range tokens {
+		if tok.Kind == TokenWord && (tok.Value == "A" || tok.Value == "B") {
+			bodies = append(bodies, tok.Body)
+		}
+	}
+	want := []string{"a\n\tb\n", "b2\n"}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("got %q, want %q", bodies, want)
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	tests := []struct {
+		input string
+		want  bool
+	}{
+		{"echo hi", true},
+		{"cat <<EOF", false},
+		{"cat <<EOF\na", false},
+		{"cat <<EOF\na\nEOF", true},
+		{"cat <<A <<B\na\nA", false},
+		{"cat <<<word", true},
+		{"echo 'abc", false},
+		{"echo 'abc\ndef'", true},
+		{`echo "a $(b`, false},
+		{"echo `date", false},
+		{"echo ${x", false},
+		{"echo $((1 +", false},
+		{"((x = 1 +", false},
+		{`echo a\`, false},
+		{"echo a\\\nb", true},
+		{`echo a\\`, true},
+		{"echo a |", false},
+		{"echo a &&", false},
+		{"echo a ||\n", false},
+		{"echo a |\nwc", true},
+		{"echo a;", true},
+		{"ls >", true},
+		{"| grep x", true},
+		{"# it's a comment", true},
+		{"if true", false},
+		{"if true; then echo a", false},
+		{"if true; then echo a; else", false},
+		{"if true; then echo a; fi", true},
+		{"while true; do", false},
+		{"for x in a b", false},
+		{"for x in a b; do echo $x; done", true},
+		{"case x in a)", false},
+		{"case x in a) echo a;; esac", true},
+		{"{ echo a", false},
+		{"{ echo a; }", true},
+		{"if true; then fi", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			if got := IsComplete(tt.input); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLineContinuation(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"echo a\\\nb", "ab\n"},
+		{"echo a \\\nb", "a b\n"},
+		{"echo \"a\\\nb\"", "ab\n"},
+		{"echo 'a\\\nb'", "a\\\nb\n"},
+		{"echo \"a\nb\"", "a\nb\n"},
+		{"echo a |\ntr a b", "b\n"},
+		{"echo a &&\n\necho b", "a\nb\n"},
+		{"false ||\necho c", "c\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, errOut := executeCapture(executor, tt.command)
+			if errOut != "" || got != tt.want {
+				t.Errorf("got %q (stderr %q), want %q", got, errOut, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompoundCommands(t *testing.T) {
+	executor := newTestExecutor()
+
+	dir := t.TempDir()
+	lines := dir + "/lines"
+	if err := os.WriteFile(lines, []byte("a b c\nd  e\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"if true; then echo yes; fi", "yes\n"},
+		{"if false; then echo yes; fi; echo $?", "0\n"},
+		{"if false; then echo 1; elif false; then echo 2; elif true; then echo 3; else echo 4; fi", "3\n"},
+		{"if false\nthen\n  echo 1\nelse\n  echo 2\nfi", "2\n"},
+		{"if false; then :; else false; fi; echo $?", "1\n"},
+		{"if echo cond; then echo body; fi | tr a-z A-Z", "COND\nBODY\n"},
+		{"i=0; while ((i < 3)); do echo $i; ((i++)); done", "0\n1\n2\n"},
+		{"i=0; until [ $i = 2 ]; do i=$((i+1)); done; echo $i", "2\n"},
+		{"while false; do :; done; echo $?", "0\n"},
+		{"for x in a 'b c' d; do echo \"[$x]\"; done", "[a]\n[b c]\n[d]\n"},
+		{"v='1 2'; for x in $v {3..4}; do echo $x; done", "1\n2\n3\n4\n"},
+		{"for x in; do echo never; done; echo done", "done\n"},
+		{"for x\ndo echo never; done", ""},
+		{"for ((i = 0; i < 3; i++)); do echo $i; done", "0\n1\n2\n"},
+		{"for ((i = 10; ; i--)) do if ((i < 8)); then break; fi; echo $i; done", "10\n9\n8\n"},
+		{"for i in 1 2 3; do if [ $i = 2 ]; then continue; fi; echo $i; done", "1\n3\n"},
+		{"for i in 1 2 3; do for j in a b c; do [ $j = b ] && continue 2; echo $i$j; done; done", "1a\n2a\n3a\n"},
+		{"for i in 1 2; do for j in a b; do break 2; done; echo never; done; echo $i$j", "1a\n"},
+		{"for i in 1 2; do break 5; done; echo $i", "1\n"},
+		{"while true; do echo once; break; echo never; done", "once\n"},
+		{"for ((i = 0; i < 4; i++)); do ((i % 2)) && continue; echo $i; done", "0\n2\n"},
+		{"x=main.go; case $x in *.c|*.h) echo c;; *.go) echo go;; *) echo other;; esac", "go\n"},
+		{"case abc in a) echo a;; (a*) echo star; esac", "star\n"},
+		{"p='*'; case x in \"$p\") echo literal;; $p) echo pattern;; esac", "pattern\n"},
+		{"case x in\n  y) echo y ;;\n  x)\n    echo x\n    ;;\nesac", "x\n"},
+		{"case x in y) echo y;; esac; echo $?", "0\n"},
+		{"case x in x) ;; esac; echo $?", "0\n"},
+		{"{ echo a; echo b; } | wc -l | tr -d ' '", "2\n"},
+		{"while read x y; do echo \"[$x|$y]\"; done < " + lines, "[a|b c]\n[d|e]\n"},
+		{"for x in 1 2; do echo $x; done > " + dir + "/out; cat " + dir + "/out", "1\n2\n"},
+		{"if true; then echo err >&2; fi 2>&1", "err\n"},
+		{"cat " + lines + " | while read -r line; do echo \"L $line\"; done", "L a b c\nL d  e\n"},
+		{"echo if then fi; { echo }; }", "if then fi\n}\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, errOut := executeCapture(executor, tt.command)
+			if errOut != "" || got != tt.want {
+				t.Errorf("got %q (stderr %q), want %q", got, errOut, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompoundSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"if true; then fi", "syntax error near unexpected token `fi'"},
+		{"then echo", "syntax error near unexpected token `then'"},
+		{"while true; done", "syntax error near unexpected token `done'"},
+		{"for 1x in a; do :; done", "syntax error near unexpected token `1x'"},
+		{"for ((i = 0; i < 3)); do :; done", "syntax error near unexpected token `((i = 0; i < 3))'"},
+		{"case x in a) echo a; esac; esac", "syntax error near unexpected token `esac'"},
+		{"case x in a echo", "syntax error near unexpected token `echo'"},
+		{"{ }", "syntax error near unexpected token `}'"},
+		{"if true; then echo a; fi fi", "syntax error near unexpected token `fi'"},
+		{"if true; then echo a", "syntax error: unexpected end of file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Parse(tt.input)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoopControlErrors(t *testing.T) {
+	executor := newTestExecutor()
+
+	const notInLoop = "break: only meaningful in a `for', `while', or `until' loop\n"
+
+	tests := []struct {
+		command string
+		want    string
+		stderr  string
+		status  string
+	}{
+		{"break", "", notInLoop, "1\n"},
+		{"for i in 1; do continue 0; done", "", "continue: 0: loop count out of range\n", "1\n"},
+		{"for i in 1; do break x; done", "", "break: x: numeric argument required\n", "1\n"},
+		{"for i in 1 2; do x=$(break); echo $i; done", "1\n2\n", notInLoop + notInLoop, "0\n"},
+		{"for i in 1 2 3; do echo it$i; done | { break; cat; }", "it1\nit2\nit3\n", notInLoop, "0\n"},
+		{"for i in 1 2; do echo $i | { break; cat; }; done", "1\n2\n", notInLoop + notInLoop, "0\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, errOut := executeCapture(executor, tt.command)
+			if got != tt.want || errOut != tt.stderr {
+				t.Errorf("got %q, stderr %q, want %q, stderr %q", got, errOut, tt.want, tt.stderr)
+			}
+			if status, _ := executeCapture(executor, "echo $?"); status != tt.status {
+				t.Errorf("status: got %q, want %q", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestRead(t *testing.T) {
+	executor := newTestExecutor()
+
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"read a b <<<'  one two  three  '; echo \"[$a][$b]\"", "[one][two  three]\n"},
+		{"read a b c <<<'one'; echo \"[$a][$b][$c]\"", "[one][][]\n"},
+		{"read <<<'  keep  '; echo \"[$REPLY]\"", "[  keep  ]\n"},
+		{"IFS=: read a b <<<'1:2:3'; echo \"[$a][$b][$IFS]\"", "[1][2:3][]\n"},
+		{"IFS=: read a b c <<<'1::3'; echo \"[$a][$b][$c]\"", "[1][][3]\n"},
+		{"read a b <<<'x\\ y z'; echo \"[$a][$b]\"", "[x y][z]\n"},
+		{"read -r a <<<'x\\ y'; echo \"[$a]\"", "[x\\ y]\n"},
+		{"printf 'a\\\nb\n' | { read x; echo \"[$x]\"; }", "[ab]\n"},
+		{"printf 'last' | { read x; echo \"$? [$x]\"; }", "1 [last]\n"},
+		{"printf '1\n2\n3\n' | { read a; read b; echo $b$a; }", "21\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			got, errOut := executeCapture(executor, tt.command)
+			if errOut != "" || got != tt.want {
+				t.Errorf("got %q (stderr %q), want %q", got, errOut, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ShellState holds the state shared between the executor and the
+// builtin commands
+type ShellState struct {
+	// LastStatus is the exit status of the most recent foreground
+	// pipeline, exposed as $?
+	LastStatus int
+
+	// PipeStatus holds the status of each stage of the most recent
+	// foreground pipeline, exposed as the PIPESTATUS array
+	PipeStatus []int
+
+	// Options holds the shell options that are switched on
+	Options map[string]bool
+
+	// Vars holds the shell variables
+	Vars *Variables
+
+	// Dir is the working directory of a subshell. It is empty in the
+	// shell itself, which uses the working directory of the process.
+	// Subshells may run alongside the shell and so cannot change that.
+	Dir string
+
+	// Subshell is set in the state of a subshell, where exit only ends
+	// the subshell. Exited is set once it has, with ExitStatus as its
+	// status, and the rest of the subshell's commands are skipped.
+	Subshell   bool
+	Exited     bool
+	ExitStatus int
+
+	// Interrupted is set once a program was killed by Ctrl+C. Like
+	// exit, it skips the rest of the command line, loops included.
+	Interrupted bool
+}
+
+// setOptions lists the options managed by set -o
+var setOptions = []string{"pipefail"}
+
+// shoptOptions lists the options managed by shopt
+var shoptOptions = []string{"dotglob", "failglob", "globstar", "nullglob"}
+
+// NewShellState creates a new ShellState instance
+func NewShellState() *ShellState {
+	return &ShellState{
+		PipeStatus: []int{0},
+		Options:    make(map[string]bool),
+		Vars:       NewVariables(),
+	}
+}
+
+// subshell returns the state a subshell starts with: a copy of the
+// variables, options, statuses and working directory. The loops around
+// the subshell are not part of it.
+func (s *ShellState) subshell() *ShellState {
+	dir, _ := s.WorkDir()
+	return &ShellState{
+		LastStatus: s.LastStatus,
+		PipeStatus: slices.Clone(s.PipeStatus),
+		Options:    maps.Clone(s.Options),
+		Vars:       s.Vars.Clone(),
+		Dir:        dir,
+		Subshell:   true,
+	}
+}
+
+// WorkDir returns the working directory
+func (s *ShellState) WorkDir() (string, error) {
+	if s.Dir != "" {
+		return s.Dir, nil
+	}
+	return os.Getwd()
+}
+
+// Path resolves a path relative to the working directory
+func (s *ShellState) Path(path string) string {
+	if s.Dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(s.Dir, path)
+}
+
+// Chdir changes the working directory
+func (s *ShellState) Chdir(dir string) error {
+	if s.Dir == "" {
+		return os.Chdir(dir)
+	}
+
+	dir = s.Path(dir)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	s.Dir = dir
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Variable is a shell variable together with its attributes
+type Variable struct {
+	Value string
+	// HasValue is false for a variable that only carries attributes,
+	// such as after "export NAME" for a variable that was never set
+	HasValue bool
+	// Exported variables are passed to the environment of commands
+	Exported bool
+	ReadOnly bool
+}
+
+// Variables is the store of shell variables. It is safe for use by
+// pipeline stages running concurrently.
+type Variables struct {
+	mu       sync.RWMutex
+	vars     map[string]*Variable
+	watchers map[string]func(string)
+}
+
+// NewVariables creates a variable store initialized from the process
+// environment. Imported variables are exported again to commands.
+func NewVariables() *Variables {
+	v := &Variables{
+		vars:     make(map[string]*Variable),
+		watchers: make(map[string]func(string)),
+	}
+	for _, kv := range os.Environ() {
+		if name, value, ok := strings.Cut(kv, "="); ok && isName(name) {
+			v.vars[name] = &Variable{Value: value, HasValue: true, Exported: true}
+		}
+	}
+	return v
+}
+
+// Clone returns a copy of the variables, without the watchers
+func (v *Variables) Clone() *Variables {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	c := &Variables{
+		vars:     make(map[string]*Variable, len(v.vars)),
+		watchers: make(map[string]func(string)),
+	}
+	for name, variable := range v.vars {
+		copied := *variable
+		c.vars[name] = &copied
+	}
+	return c
+}
+
+// Watch registers fn to be called with the new value whenever the
+// variable is assigned or unset
+func (v *Variables) Watch(name string, fn func(string)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.watchers[name] = fn
+}
+
+func (v *Variables) notify(name, value string) {
+	v.mu.RLock()
+	fn := v.watchers[name]
+	v.mu.RUnlock()
+
+	if fn != nil {
+		fn(value)
+	}
+}
+
+// Get returns the value of a variable and whether it is set
+func (v *Variables) Get(name string) (string, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if variable, ok := v.vars[name]; ok && variable.HasValue {
+		return variable.Value, true
+	}
+	return "", false
+}
+
+// Lookup returns a copy of a variable including its attributes
+func (v *Variables) Lookup(name string) (Variable, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if variable, ok := v.vars[name]; ok {
+		return *variable, true
+	}
+	return Variable{}, false
+}
+
+// Set assigns a value to a variable, creating it if needed
+func (v *Variables) Set(name, value string) error {
+	v.mu.Lock()
+	variable, ok := v.vars[name]
+	switch {
+	case !ok:
+		v.vars[name] = &Variable{Value: value, HasValue: true}
+	case variable.ReadOnly:
+		v.mu.Unlock()
+		return fmt.Errorf("%s: readonly variable", name)
+	default:
+		variable.Value, variable.HasValue = value, true
+	}
+	v.mu.Unlock()
+
+	v.notify(name, value)
+	return nil
+}
+
+// Unset removes a variable
+func (v *Variables) Unset(name string) error {
+	v.mu.Lock()
+	variable, ok := v.vars[name]
+	if ok && variable.ReadOnly {
+		v.mu.Unlock()
+		return fmt.Errorf("%s: cannot unset: readonly variable", name)
+	}
+	delete(v.vars, name)
+	v.mu.Unlock()
+
+	if ok {
+		v.notify(name, "")
+	}
+	return nil
+}
+
+// SetExported sets or clears the export attribute of a variable,
+// creating it without a value if needed
+func (v *Variables) SetExported(name string, exported bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if variable, ok := v.vars[name]; ok {
+		variable.Exported = exported
+		return
+	}
+	v.vars[name] = &Variable{Exported: exported}
+}
+
+// SetReadOnly marks a variable read-only, creating it without a value
+// if needed
+func (v *Variables) SetReadOnly(name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if variable, ok := v.vars[name]; ok {
+		variable.ReadOnly = true
+		return
+	}
+	v.vars[name] = &Variable{ReadOnly: true}
+}
+
+// Names returns the names of all variables in sorted order
+func (v *Variables) Names() []string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	names := make([]string, 0, len(v.vars))
+	for name := range v.vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Environ returns the exported variables that have a value in the
+// NAME=value form used for the environment of a command
+func (v *Variables) Environ() []string {
+	var env []string
+	for _, name := range v.Names() {
+		variable, ok := v.Lookup(name)
+		if ok && variable.Exported && variable.HasValue {
+			env = append(env, name+"="+variable.Value)
+		}
+	}
+	return env
+}
+
+// isName reports whether s is a valid variable name
+func isName(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s, i) {
+			return false
+		}
+	}
+	return true
+}
+
+// isNameChar reports whether text[i] can be part of a variable name
+func isNameChar(text string, i int) bool {
+	if i >= len(text) {
+		return false
+	}
+	c := text[i]
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// assignmentName returns the variable name of a NAME=value word, or
+// false if the word is not an assignment
+func assignmentName(word string) (string, bool) {
+	name, _, ok := strings.Cut(word, "=")
+	if !ok || !isName(name) {
+		return "", false
+	}
+	return name, true
+}